@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/experimental-platform/platform-central-gateway/proxy"
+
+	"golang.org/x/net/context"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// accessLog writes a line for every request served on the traffic listeners,
+// either in the combined log format (with some fields appended) or as JSON.
+type accessLog struct {
+	logger *log.Logger
+	file   *logFile
+	json   bool
+}
+
+// newAccessLog creates the access log writing to "stdout" or a file,
+// "off" disables access logging and gives a nil log.
+func newAccessLog(target, format string) (*accessLog, error) {
+	if target == "off" {
+		return nil, nil
+	}
+
+	l := &accessLog{logger: log.New()}
+	switch format {
+	case "combined":
+		l.logger.Formatter = messageFormatter{}
+	case "json":
+		l.logger.Formatter = &log.JSONFormatter{}
+		l.json = true
+	default:
+		return nil, fmt.Errorf("unknown access log format '%s'", format)
+	}
+
+	if target == "stdout" {
+		l.logger.Out = os.Stdout
+		return l, nil
+	}
+
+	file, err := openLogFile(target)
+	if err != nil {
+		return nil, err
+	}
+	l.file = file
+	l.logger.Out = file
+	return l, nil
+}
+
+// reopen reopens the log file, so it can be rotated.
+func (l *accessLog) reopen() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	return l.file.reopen()
+}
+
+// accessEntry collects the details of a request while it is served.
+type accessEntry struct {
+	route    string
+	sample   float64
+	upstream proxy.RequestInfo
+}
+
+type accessEntryContextKey struct{}
+
+// labelAccessLog tells the access log which route served a request
+// and which share of its requests should be logged.
+func labelAccessLog(req *http.Request, route string, sample float64) {
+	if entry, ok := req.Context().Value(accessEntryContextKey{}).(*accessEntry); ok {
+		entry.route = route
+		entry.sample = sample
+	}
+}
+
+// sampled decides whether a finished request is logged. Failures always are.
+func (e *accessEntry) sampled(status int) bool {
+	if status >= 500 || e.upstream.Err != nil {
+		return true
+	}
+	return e.sample >= 1 || rand.Float64() < e.sample
+}
+
+// wrap logs all requests served by the handler, a nil log doesn't log anything.
+func (l *accessLog) wrap(handler http.Handler) http.Handler {
+	if l == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		// the proxy rewrites the request, so remember what the client sent
+		line := accessLine{
+			remoteAddr: req.RemoteAddr,
+			method:     req.Method,
+			uri:        req.RequestURI,
+			proto:      req.Proto,
+			host:       req.Host,
+			referer:    req.Referer(),
+			userAgent:  req.UserAgent(),
+		}
+		line.user, _, _ = req.BasicAuth()
+
+		entry := &accessEntry{route: "-", sample: 1}
+		req = req.WithContext(context.WithValue(req.Context(), accessEntryContextKey{}, entry))
+		req = proxy.WithRequestInfo(req, &entry.upstream)
+
+		rw := &statusWriter{ResponseWriter: w}
+		handler.ServeHTTP(rw, req)
+
+		line.status = rw.statusCode(req.Method)
+		if !entry.sampled(line.status) {
+			return
+		}
+		line.time = start
+		line.latency = time.Since(start)
+		line.bytes = rw.bytes
+		line.route = entry.route
+		line.backend = entry.upstream.Backend
+		if entry.upstream.Err != nil {
+			line.err = entry.upstream.Err.Error()
+		}
+		l.write(line)
+	})
+}
+
+type accessLine struct {
+	time       time.Time
+	remoteAddr string
+	user       string
+	method     string
+	uri        string
+	proto      string
+	host       string
+	referer    string
+	userAgent  string
+	status     int
+	bytes      int64
+	latency    time.Duration
+	route      string
+	backend    string
+	err        string
+}
+
+func (l *accessLog) write(line accessLine) {
+	clientIP, _, err := net.SplitHostPort(line.remoteAddr)
+	if err != nil {
+		clientIP = line.remoteAddr
+	}
+
+	if l.json {
+		fields := log.Fields{
+			"remote_addr": clientIP,
+			"method":      line.method,
+			"uri":         line.uri,
+			"proto":       line.proto,
+			"host":        line.host,
+			"route":       line.route,
+			"status":      line.status,
+			"bytes":       line.bytes,
+			"latency_ms":  float64(line.latency) / float64(time.Millisecond),
+		}
+		for key, value := range map[string]string{
+			"user":       line.user,
+			"referer":    line.referer,
+			"user_agent": line.userAgent,
+			"backend":    line.backend,
+			"error":      line.err,
+		} {
+			if value != "" {
+				fields[key] = value
+			}
+		}
+		l.logger.WithFields(fields).Info("access")
+		return
+	}
+
+	bytes := "-"
+	if line.bytes > 0 {
+		bytes = fmt.Sprintf("%d", line.bytes)
+	}
+	l.logger.Infof("%s - %s [%s] %q %d %s %q %q %q %s %s %.3f %q",
+		clientIP, orDash(line.user), line.time.Format("02/Jan/2006:15:04:05 -0700"),
+		line.method+" "+line.uri+" "+line.proto, line.status, bytes,
+		orDash(line.referer), orDash(line.userAgent), orDash(line.host),
+		orDash(line.route), orDash(line.backend), line.latency.Seconds(), orDash(line.err))
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// messageFormatter writes nothing but the message, the combined log lines are
+// built completely by the access log.
+type messageFormatter struct{}
+
+func (messageFormatter) Format(entry *log.Entry) ([]byte, error) {
+	return []byte(entry.Message + "\n"), nil
+}
+
+// statusWriter records the status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streaming responses working.
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack keeps websockets and CONNECT tunnels working.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	w.hijacked = true
+	return hijacker.Hijack()
+}
+
+// statusCode is the status sent to the client, hijacked connections
+// were either upgraded or tunneled.
+func (w *statusWriter) statusCode(method string) int {
+	switch {
+	case w.status != 0:
+		return w.status
+	case w.hijacked && method == "CONNECT":
+		return http.StatusOK
+	case w.hijacked:
+		return http.StatusSwitchingProtocols
+	default:
+		return http.StatusOK
+	}
+}
+
+// logFile is an append-only file which can be reopened after log rotation.
+type logFile struct {
+	path  string
+	file  *os.File
+	mutex sync.Mutex
+}
+
+func openLogFile(path string) (*logFile, error) {
+	f := &logFile{path: path}
+	if err := f.reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *logFile) reopen() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	old := f.file
+	f.file = file
+	f.mutex.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (f *logFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Write(p)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/experimental-platform/platform-central-gateway/proxy"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAccessLog(t *testing.T, format string) (*accessLog, *bytes.Buffer) {
+	l, err := newAccessLog("stdout", format)
+	assert.Nil(t, err)
+	buf := &bytes.Buffer{}
+	l.logger.Out = buf
+	return l, buf
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	l, buf := newTestAccessLog(t, "combined")
+	handler := l.wrap(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		labelAccessLog(req, "route box.local/devices/", 1)
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write([]byte("hello"))
+	}))
+
+	req := httptest.NewRequest("POST", "http://box.local/devices/1", nil)
+	req.Header.Set("User-Agent", "curl/7.47.0")
+	req.SetBasicAuth("admin", "secret")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := buf.String()
+	assert.True(t, strings.HasPrefix(line, "192.0.2.1 - admin ["), line)
+	assert.Contains(t, line, `"POST http://box.local/devices/1 HTTP/1.1" 201 5 "-" "curl/7.47.0" "box.local" route box.local/devices/ - `)
+	assert.True(t, strings.HasSuffix(line, " \"-\"\n"), line)
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	backendURL, _ := url.Parse(backend.URL)
+	backend.Close()
+	appProxy := proxy.New(backendURL)
+
+	l, buf := newTestAccessLog(t, "json")
+	handler := l.wrap(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		labelAccessLog(req, "app gitlab", 1)
+		appProxy.ServeHTTP(rw, req)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	var fields map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &fields))
+	assert.Equal(t, "app gitlab", fields["route"])
+	assert.Equal(t, float64(http.StatusBadGateway), fields["status"])
+	assert.Equal(t, backendURL.Host, fields["backend"])
+	assert.NotEmpty(t, fields["error"])
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	l, buf := newTestAccessLog(t, "combined")
+	status := http.StatusOK
+	handler := l.wrap(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		labelAccessLog(req, "app chatty", 0)
+		rw.WriteHeader(status)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, 0, buf.Len())
+
+	// failures are logged regardless of sampling
+	status = http.StatusServiceUnavailable
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.Contains(t, buf.String(), " 503 ")
+}
+
+func TestAccessLogOff(t *testing.T) {
+	l, err := newAccessLog("off", "combined")
+	assert.Nil(t, err)
+	assert.Nil(t, l)
+	assert.Nil(t, l.reopen())
+
+	handler := &testHandler{"app"}
+	assert.Equal(t, http.Handler(handler), l.wrap(handler))
+
+	_, err = newAccessLog("stdout", "common")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+
+	log "github.com/Sirupsen/logrus"
+	skvs "github.com/experimental-platform/platform-skvs/client"
+)
+
+// path below which HTTP-01 challenges are answered
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+const (
+	acmeHTTP01    = "http-01"
+	acmeTLSALPN01 = "tls-alpn-01"
+)
+
+// acmeManager obtains and renews the certificates of the app hostnames from an
+// ACME CA like Let's Encrypt. Certificates are written to 'apps/<name>/acme' in
+// SKVS, next to the apps' own certificates, which are never touched.
+type acmeManager struct {
+	client *acme.Client
+	store  *skvs.Client
+	certs  *certStore
+	// all apps, whose certificates are reloaded after issuing, nil reloads the renewed ones
+	appNames   func() []string
+	email      string
+	challenges []string
+	registered bool
+
+	mutex sync.RWMutex
+	// key authorizations by token
+	httpTokens map[string]string
+	// challenge certificates by domain
+	alpnCerts map[string]*tls.Certificate
+}
+
+// newACMEManager creates the manager for the ACME directory. The CA file lists
+// additional CAs trusted for the directory, e.g. the one of a Pebble test server.
+func newACMEManager(directoryURL, email, caFile, challenges string, store *skvs.Client, certs *certStore) (*acmeManager, error) {
+	m := &acmeManager{
+		client:     &acme.Client{DirectoryURL: directoryURL, UserAgent: "central-gateway"},
+		store:      store,
+		certs:      certs,
+		email:      email,
+		httpTokens: make(map[string]string),
+		alpnCerts:  make(map[string]*tls.Certificate),
+	}
+
+	for _, challenge := range strings.Split(challenges, ",") {
+		challenge = strings.TrimSpace(challenge)
+		if challenge != acmeHTTP01 && challenge != acmeTLSALPN01 {
+			return nil, fmt.Errorf("unsupported ACME challenge '%s'", challenge)
+		}
+		m.challenges = append(m.challenges, challenge)
+	}
+
+	if caFile != "" {
+		caData, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates found in '%s'", caFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		m.client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	return m, nil
+}
+
+// register loads or creates the account key, which is kept in SKVS
+// at 'acme/account_key', and registers the account with the CA.
+func (m *acmeManager) register(ctx context.Context) error {
+	if m.registered {
+		return nil
+	}
+
+	var key *ecdsa.PrivateKey
+	keyPEM, err := m.store.Get("acme/account_key")
+	if err == nil {
+		block, _ := pem.Decode([]byte(keyPEM))
+		if block == nil {
+			return errors.New("invalid ACME account key")
+		}
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return fmt.Errorf("invalid ACME account key: %s", err.Error())
+		}
+	} else if !skvsNotFound(err) {
+		// a new key would replace the account for good
+		return fmt.Errorf("reading ACME account key: %s", err.Error())
+	} else {
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return err
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+		if err = m.store.Set("acme/account_key", string(keyPEM)); err != nil {
+			return fmt.Errorf("saving ACME account key: %s", err.Error())
+		}
+	}
+	m.client.Key = key
+
+	account := &acme.Account{}
+	if m.email != "" {
+		account.Contact = []string{"mailto:" + m.email}
+	}
+	if _, err := m.client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return fmt.Errorf("registering ACME account: %s", err.Error())
+	}
+
+	m.registered = true
+	return nil
+}
+
+// needsCertificate tells whether an app lacks a valid certificate for its domain.
+// Apps whose own certificate covers the domain are left alone.
+func (m *acmeManager) needsCertificate(appName, domain string) bool {
+	if leaf := m.certs.appCertificate(appName); leaf != nil && leaf.VerifyHostname(domain) == nil {
+		return false
+	}
+	leaf := m.certs.acmeCertificate(appName)
+	if leaf == nil || leaf.VerifyHostname(domain) != nil {
+		return true
+	}
+	return renewalDue(leaf, time.Now())
+}
+
+// renewalDue tells whether only a third of a certificate's lifetime is left,
+// the renewal time recommended by Let's Encrypt.
+func renewalDue(leaf *x509.Certificate, now time.Time) bool {
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	return now.After(leaf.NotAfter.Add(-lifetime / 3))
+}
+
+// renew obtains certificates for all apps without a valid one.
+// The domains are the hostnames by app name.
+func (m *acmeManager) renew(ctx context.Context, domains map[string]string) error {
+	appNames := make([]string, 0, len(domains))
+	for appName := range domains {
+		appNames = append(appNames, appName)
+	}
+	sort.Strings(appNames)
+
+	var failed []string
+	issued := 0
+	for _, appName := range appNames {
+		domain := domains[appName]
+		if !m.needsCertificate(appName, domain) {
+			continue
+		}
+
+		if err := m.register(ctx); err != nil {
+			return err
+		}
+
+		log.Infof("Requesting ACME certificate for %s", domain)
+		if err := m.obtain(ctx, appName, domain); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", domain, err.Error()))
+			continue
+		}
+		issued++
+	}
+
+	if issued > 0 {
+		if m.appNames != nil {
+			appNames = m.appNames()
+		}
+		if err := m.certs.reload(appNames); err != nil {
+			log.Errorf("Reloading TLS certificates: %s", err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("obtaining ACME certificates failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// obtain orders a certificate for the domain and stores it in SKVS as the app's ACME certificate.
+func (m *acmeManager) obtain(ctx context.Context, appName, domain string) error {
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return err
+	}
+	// only the response creating the order tells its URL
+	orderURL := order.URI
+
+	for _, authzURL := range order.AuthzURLs {
+		if err = m.authorize(ctx, authzURL); err != nil {
+			return err
+		}
+	}
+
+	if order, err = m.client.WaitOrder(ctx, orderURL); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		// CAs issuing asynchronously may not repeat the order URL when finalizing
+		finalized, waitErr := m.client.WaitOrder(ctx, orderURL)
+		if waitErr != nil || finalized.CertURL == "" {
+			return err
+		}
+		if chain, err = m.client.FetchCert(ctx, finalized.CertURL, true); err != nil {
+			return err
+		}
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err = m.store.Set(fmt.Sprintf("apps/%s/acme/pem", appName), string(certPEM)); err != nil {
+		return err
+	}
+	return m.store.Set(fmt.Sprintf("apps/%s/acme/key", appName), string(keyPEM))
+}
+
+// authorize proves control over the domain of an authorization
+// with the first supported challenge.
+func (m *acmeManager) authorize(ctx context.Context, authzURL string) error {
+	authz, err := m.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, challengeType := range m.challenges {
+		for _, c := range authz.Challenges {
+			if c.Type == challengeType && challenge == nil {
+				challenge = c
+			}
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no supported challenge offered for %s", authz.Identifier.Value)
+	}
+
+	cleanup, err := m.prepareChallenge(challenge, authz.Identifier.Value)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if _, err = m.client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+	_, err = m.client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// prepareChallenge makes the gateway answer a challenge until cleanup is called.
+func (m *acmeManager) prepareChallenge(challenge *acme.Challenge, domain string) (func(), error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	switch challenge.Type {
+	case acmeHTTP01:
+		keyAuth, err := m.client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return nil, err
+		}
+		m.httpTokens[challenge.Token] = keyAuth
+		return func() {
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			delete(m.httpTokens, challenge.Token)
+		}, nil
+
+	case acmeTLSALPN01:
+		cert, err := m.client.TLSALPN01ChallengeCert(challenge.Token, domain)
+		if err != nil {
+			return nil, err
+		}
+		m.alpnCerts[domain] = &cert
+		return func() {
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			delete(m.alpnCerts, domain)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported ACME challenge '%s'", challenge.Type)
+}
+
+// handleHTTPChallenge answers pending HTTP-01 challenges and passes all other
+// requests on, including challenges of apps running their own ACME client.
+// A nil manager doesn't answer anything.
+func (m *acmeManager) handleHTTPChallenge(handler http.Handler) http.Handler {
+	if m == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, acmeChallengePath) {
+			m.mutex.RLock()
+			keyAuth, ok := m.httpTokens[strings.TrimPrefix(req.URL.Path, acmeChallengePath)]
+			m.mutex.RUnlock()
+
+			if ok {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte(keyAuth))
+				return
+			}
+		}
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// configureTLS makes a TLS config answer pending TLS-ALPN-01 challenges.
+func (m *acmeManager) configureTLS(config *tls.Config) {
+	if m == nil {
+		return
+	}
+
+	getCertificate := config.GetCertificate
+	config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != acme.ALPNProto {
+			return getCertificate(hello)
+		}
+
+		m.mutex.RLock()
+		defer m.mutex.RUnlock()
+		if cert, ok := m.alpnCerts[normalizeHost(hello.ServerName)]; ok {
+			return cert, nil
+		}
+		return nil, fmt.Errorf("no pending ACME challenge for '%s'", hello.ServerName)
+	}
+}
+
+// run renews the certificates of the app hostnames periodically, starting right away.
+func (m *acmeManager) run(interval time.Duration, domains func() map[string]string, stop chan struct{}) {
+	if m == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		if err := m.renew(ctx, domains()); err != nil {
+			log.Errorf("ACME: %s", err.Error())
+		}
+		cancel()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/experimental-platform/platform-skvs/client"
+	"github.com/experimental-platform/platform-skvs/server"
+)
+
+func TestACMEHTTPChallenge(t *testing.T) {
+	m, err := newACMEManager("https://acme.invalid/directory", "", "", "http-01", nil, nil)
+	assert.Nil(t, err)
+	m.httpTokens["token"] = "token.thumbprint"
+	handler := m.handleHTTPChallenge(&testHandler{"app"})
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/.well-known/acme-challenge/token", nil))
+	assert.Equal(t, "token.thumbprint", rw.Body.String())
+
+	// challenges of apps doing ACME themselves are passed on
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/.well-known/acme-challenge/other", nil))
+	assert.Equal(t, "app", rw.Body.String())
+
+	var disabled *acmeManager
+	assert.Equal(t, http.Handler(&testHandler{"app"}), disabled.handleHTTPChallenge(&testHandler{"app"}))
+}
+
+func TestACMETLSALPNChallenge(t *testing.T) {
+	m, err := newACMEManager("https://acme.invalid/directory", "", "", "tls-alpn-01,http-01", nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{acmeTLSALPN01, acmeHTTP01}, m.challenges)
+
+	boxCert := &tls.Certificate{}
+	challengeCert := &tls.Certificate{}
+	m.alpnCerts["gitlab.box.local"] = challengeCert
+
+	config := &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return boxCert, nil
+	}}
+	m.configureTLS(config)
+	assert.Contains(t, config.NextProtos, acme.ALPNProto)
+
+	cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "gitlab.box.local", SupportedProtos: []string{acme.ALPNProto}})
+	assert.Nil(t, err)
+	assert.True(t, cert == challengeCert)
+
+	cert, err = config.GetCertificate(&tls.ClientHelloInfo{ServerName: "gitlab.box.local", SupportedProtos: []string{"h2", "http/1.1"}})
+	assert.Nil(t, err)
+	assert.True(t, cert == boxCert)
+
+	_, err = config.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.box.local", SupportedProtos: []string{acme.ALPNProto}})
+	assert.NotNil(t, err)
+
+	_, err = newACMEManager("https://acme.invalid/directory", "", "", "dns-01", nil, nil)
+	assert.NotNil(t, err)
+}
+
+func TestACMENeedsCertificate(t *testing.T) {
+	store, c := newTestCertStore(t)
+	certPEM, keyPEM := generateCert(t, "box.local")
+	assert.Nil(t, c.Set("ssl/pem", certPEM))
+	assert.Nil(t, c.Set("ssl/key", keyPEM))
+	certPEM, keyPEM = generateCert(t, "gitlab.box.local")
+	assert.Nil(t, c.Set("apps/gitlab/ssl/pem", certPEM))
+	assert.Nil(t, c.Set("apps/gitlab/ssl/key", keyPEM))
+	assert.Nil(t, store.reload([]string{"gitlab"}))
+
+	m, err := newACMEManager("https://acme.invalid/directory", "", "", "http-01", c, store)
+	assert.Nil(t, err)
+
+	assert.False(t, m.needsCertificate("gitlab", "gitlab.box.local"))
+	assert.True(t, m.needsCertificate("gitlab", "gitlab.other.local"))
+	assert.True(t, m.needsCertificate("owncloud", "owncloud.box.local"))
+
+	// ACME certificates are kept apart from the apps' own ones
+	certPEM, keyPEM = generateCert(t, "gitlab.other.local")
+	assert.Nil(t, c.Set("apps/gitlab/acme/pem", certPEM))
+	assert.Nil(t, c.Set("apps/gitlab/acme/key", keyPEM))
+	assert.Nil(t, store.reload([]string{"gitlab"}))
+	assert.False(t, m.needsCertificate("gitlab", "gitlab.other.local"))
+	assert.Equal(t, []string{"gitlab.box.local"}, store.appCertificate("gitlab").DNSNames)
+
+	issued := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	leaf := &x509.Certificate{NotBefore: issued, NotAfter: issued.Add(90 * 24 * time.Hour)}
+	assert.False(t, renewalDue(leaf, issued.Add(59*24*time.Hour)))
+	assert.True(t, renewalDue(leaf, issued.Add(61*24*time.Hour)))
+}
+
+func TestACMERegisterKeepsAccountKey(t *testing.T) {
+	testDataPath, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	skvsServer := httptest.NewServer(server.NewServerHandler(testDataPath, nil, nil))
+	c := client.NewFromURL(skvsServer.URL)
+
+	m, err := newACMEManager("https://acme.invalid/directory", "", "", "http-01", c, nil)
+	assert.Nil(t, err)
+	// the key is created, registering at the CA fails
+	assert.NotNil(t, m.register(context.Background()))
+	keyPEM, err := c.Get("acme/account_key")
+	assert.Nil(t, err)
+
+	// an unreachable SKVS doesn't replace the account
+	skvsServer.Close()
+	err = m.register(context.Background())
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "reading ACME account key")
+	}
+	skvsServer = httptest.NewServer(server.NewServerHandler(testDataPath, nil, nil))
+	defer skvsServer.Close()
+	kept, err := client.NewFromURL(skvsServer.URL).Get("acme/account_key")
+	assert.Nil(t, err)
+	assert.Equal(t, keyPEM, kept)
+}
+
+// TestACMEPebble obtains a certificate from a Pebble test server, e.g. started by
+//
+//	pebble-challtestsrv -defaultIPv4 127.0.0.1 &
+//	pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053
+//
+// and run with PEBBLE_DIRECTORY=https://127.0.0.1:14000/dir and PEBBLE_CA set to
+// Pebble's test/certs/pebble.minica.pem. Pebble validates challenges on the
+// ports 5002 (HTTP-01) and 5001 (TLS-ALPN-01) of 127.0.0.1.
+func TestACMEPebble(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY not set")
+	}
+
+	for _, challenge := range []string{acmeHTTP01, acmeTLSALPN01} {
+		store, c := newTestCertStore(t)
+		certPEM, keyPEM := generateCert(t, "box.local")
+		assert.Nil(t, c.Set("ssl/pem", certPEM))
+		assert.Nil(t, c.Set("ssl/key", keyPEM))
+		assert.Nil(t, store.reload(nil))
+
+		m, err := newACMEManager(directory, "admin@box.local", os.Getenv("PEBBLE_CA"), challenge, c, store)
+		assert.Nil(t, err)
+
+		httpListener, err := net.Listen("tcp", "127.0.0.1:5002")
+		assert.Nil(t, err)
+		go http.Serve(httpListener, m.handleHTTPChallenge(http.NotFoundHandler()))
+
+		tlsConfig := &tls.Config{GetCertificate: store.getCertificate}
+		m.configureTLS(tlsConfig)
+		tlsListener, err := tls.Listen("tcp", "127.0.0.1:5001", tlsConfig)
+		assert.Nil(t, err)
+		go http.Serve(tlsListener, http.NotFoundHandler())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err = m.renew(ctx, map[string]string{"gitlab": "gitlab.box.protonet.info"})
+		cancel()
+		httpListener.Close()
+		tlsListener.Close()
+		assert.Nil(t, err, challenge)
+
+		assert.False(t, m.needsCertificate("gitlab", "gitlab.box.protonet.info"), challenge)
+		cert, err := store.getCertificate(&tls.ClientHelloInfo{ServerName: "gitlab.box.protonet.info"})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"gitlab.box.protonet.info"}, cert.Leaf.DNSNames)
+
+		// the account is kept in SKVS, the app's own certificate isn't touched
+		_, err = c.Get("acme/account_key")
+		assert.Nil(t, err)
+		_, err = c.Get("apps/gitlab/ssl/pem")
+		assert.True(t, skvsNotFound(err))
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	skvs "github.com/experimental-platform/platform-skvs/client"
+)
+
+// pre-generated self-signed certificate used if SKVS has none
+var (
+	defaultCertFile = "/data/ssl/pem"
+	defaultKeyFile  = "/data/ssl/key"
+)
+
+const boxCertName = "box"
+
+// prefix of the certStore names of certificates obtained by ACME
+const acmeCertPrefix = "acme/"
+
+// certStore serves TLS certificates by SNI. The box certificate is read from SKVS
+// at 'ssl/pem' and 'ssl/key'. Apps may have their own certificate at
+// 'apps/<name>/ssl/pem' and 'apps/<name>/ssl/key', which is served for all names
+// it covers. Certificates obtained by ACME are kept apart at 'apps/<name>/acme/pem'
+// and 'apps/<name>/acme/key', an app's own certificate wins for the names both cover.
+// The box CA at 'ssl/client_ca' verifies client certificates.
+// Certificates and keys are kept in memory only.
+type certStore struct {
+	client *skvs.Client
+
+	mutex sync.RWMutex
+	// by app name, boxCertName for the box certificate
+	// and acmeCertPrefix+app name for ACME ones
+	certs  map[string]*loadedCert
+	byName map[string]*tls.Certificate
+	// box CA for client certificates, nil if there is none
+	clientCAs    *x509.CertPool
+	clientCAData string
+}
+
+type loadedCert struct {
+	cert    *tls.Certificate
+	pemData string
+}
+
+func newCertStore(client *skvs.Client) (*certStore, error) {
+	if client == nil {
+		var err error
+		if client, err = skvs.NewFromDocker(); err != nil {
+			return nil, fmt.Errorf("newCertStore: %s", err.Error())
+		}
+	}
+
+	return &certStore{client: client}, nil
+}
+
+func parseCertificate(pemData, keyData string) (*loadedCert, error) {
+	cert, err := tls.X509KeyPair([]byte(pemData), []byte(keyData))
+	if err != nil {
+		return nil, err
+	}
+
+	// the leaf tells which names the certificate is served for
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &loadedCert{cert: &cert, pemData: pemData}, nil
+}
+
+// loadCert reads a certificate and its key from SKVS, nil if there is none.
+// Failed reads are errors, so the previous certificate is kept.
+func (s *certStore) loadCert(prefix string) (*loadedCert, error) {
+	pemData, err := s.client.Get(prefix + "/pem")
+	if skvsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyData, err := s.client.Get(prefix + "/key")
+	if skvsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCertificate(pemData, keyData)
+}
+
+func (s *certStore) loadBoxCert() (*loadedCert, error) {
+	cert, err := s.loadCert("ssl")
+	if cert != nil || err != nil {
+		return cert, err
+	}
+	return loadDefaultCert()
+}
+
+// loadDefaultCert reads the self-signed certificate of the box.
+func loadDefaultCert() (*loadedCert, error) {
+	pemData, err := ioutil.ReadFile(defaultCertFile)
+	if err != nil {
+		return nil, err
+	}
+	keyData, err := ioutil.ReadFile(defaultKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseCertificate(string(pemData), string(keyData))
+}
+
+// reload reads the box certificate and the certificates of the apps. Invalid
+// certificates are reported and replaced by their previous version, if any.
+func (s *certStore) reload(appNames []string) error {
+	s.mutex.RLock()
+	previous := s.certs
+	previousCAs, previousCAData := s.clientCAs, s.clientCAData
+	s.mutex.RUnlock()
+
+	certs := make(map[string]*loadedCert)
+	var failed []string
+
+	box, err := s.loadBoxCert()
+	if err != nil {
+		failed = append(failed, fmt.Sprintf("%s: %s", boxCertName, err.Error()))
+		box = previous[boxCertName]
+		if box == nil {
+			// nothing to keep yet, the self-signed certificate beats none
+			box, _ = loadDefaultCert()
+		}
+	}
+	if box == nil {
+		return fmt.Errorf("no TLS certificate for the box: %s", err.Error())
+	}
+	certs[boxCertName] = box
+
+	for _, appName := range appNames {
+		for name, prefix := range map[string]string{
+			appName:                  fmt.Sprintf("apps/%s/ssl", appName),
+			acmeCertPrefix + appName: fmt.Sprintf("apps/%s/acme", appName),
+		} {
+			cert, err := s.loadCert(prefix)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %s", name, err.Error()))
+				cert = previous[name]
+			}
+			if cert != nil {
+				certs[name] = cert
+			}
+		}
+	}
+
+	clientCAs, clientCAData, err := s.loadClientCAs()
+	if err != nil {
+		failed = append(failed, fmt.Sprintf("client CA: %s", err.Error()))
+		clientCAs, clientCAData = previousCAs, previousCAData
+	} else if clientCAData != previousCAData && clientCAs != nil {
+		log.Infof("Loaded client CA from '%s'", clientCAName)
+	}
+
+	byName := make(map[string]*tls.Certificate)
+	for name, cert := range certs {
+		if old, ok := previous[name]; !ok || old.pemData != cert.pemData {
+			log.Infof("Loaded TLS certificate of %s for %s", name, strings.Join(cert.cert.Leaf.DNSNames, ", "))
+		}
+	}
+	// ACME certificates first, the apps' own ones replace them
+	for _, acme := range []bool{true, false} {
+		for name, cert := range certs {
+			if name == boxCertName || strings.HasPrefix(name, acmeCertPrefix) != acme {
+				continue
+			}
+			for _, dnsName := range cert.cert.Leaf.DNSNames {
+				byName[normalizeHost(dnsName)] = cert.cert
+			}
+		}
+	}
+
+	s.mutex.Lock()
+	s.certs = certs
+	s.byName = byName
+	s.clientCAs = clientCAs
+	s.clientCAData = clientCAData
+	s.mutex.Unlock()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("invalid TLS certificates: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// appCertificate returns the leaf of an app's own certificate, nil if it has none.
+func (s *certStore) appCertificate(appName string) *x509.Certificate {
+	if appName == boxCertName {
+		return nil
+	}
+	return s.leaf(appName)
+}
+
+// acmeCertificate returns the leaf of an app's ACME certificate, nil if it has none.
+func (s *certStore) acmeCertificate(appName string) *x509.Certificate {
+	return s.leaf(acmeCertPrefix + appName)
+}
+
+func (s *certStore) leaf(name string) *x509.Certificate {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if cert, ok := s.certs[name]; ok {
+		return cert.cert.Leaf
+	}
+	return nil
+}
+
+// getCertificate picks the certificate for the server name a client asked for,
+// falling back to the box certificate.
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if serverName := normalizeHost(hello.ServerName); serverName != "" {
+		for _, pattern := range hostPatterns(serverName) {
+			if cert, ok := s.byName[pattern]; ok {
+				return cert, nil
+			}
+		}
+	}
+
+	if box, ok := s.certs[boxCertName]; ok {
+		return box.cert, nil
+	}
+	return nil, errors.New("no TLS certificate loaded")
+}
+
+// watch reloads the certificates periodically, so they can be rotated in SKVS.
+func (s *certStore) watch(interval time.Duration, appNames func() []string, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := s.reload(appNames()); err != nil {
+				log.Errorf("Reloading TLS certificates: %s", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/experimental-platform/platform-skvs/client"
+	"github.com/experimental-platform/platform-skvs/server"
+)
+
+// generateCert creates a self-signed certificate and key in PEM format.
+func generateCert(t *testing.T, names ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test"},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func newTestCertStore(t *testing.T) (*certStore, *client.Client) {
+	testDataPath, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+
+	srv := httptest.NewServer(server.NewServerHandler(testDataPath, nil, nil))
+	c := client.NewFromURL(srv.URL)
+	store, err := newCertStore(c)
+	assert.Nil(t, err)
+	return store, c
+}
+
+func servedNames(t *testing.T, store *certStore, serverName string) []string {
+	cert, err := store.getCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	assert.Nil(t, err)
+	return cert.Leaf.DNSNames
+}
+
+func TestCertStoreDefaultCert(t *testing.T) {
+	store, _ := newTestCertStore(t)
+
+	dir, err := ioutil.TempDir("", "ssl")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(certFile, keyFile string) {
+		defaultCertFile, defaultKeyFile = certFile, keyFile
+	}(defaultCertFile, defaultKeyFile)
+	defaultCertFile = filepath.Join(dir, "pem")
+	defaultKeyFile = filepath.Join(dir, "key")
+
+	// neither SKVS nor the files have a certificate
+	assert.NotNil(t, store.reload(nil))
+	_, err = store.getCertificate(&tls.ClientHelloInfo{})
+	assert.NotNil(t, err)
+
+	certPEM, keyPEM := generateCert(t, "self-signed.local")
+	assert.Nil(t, ioutil.WriteFile(defaultCertFile, []byte(certPEM), 0600))
+	assert.Nil(t, ioutil.WriteFile(defaultKeyFile, []byte(keyPEM), 0600))
+
+	assert.Nil(t, store.reload(nil))
+	assert.Equal(t, []string{"self-signed.local"}, servedNames(t, store, "box.local"))
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	store, c := newTestCertStore(t)
+
+	certPEM, keyPEM := generateCert(t, "box.local")
+	assert.Nil(t, c.Set("ssl/pem", certPEM))
+	assert.Nil(t, c.Set("ssl/key", keyPEM))
+	certPEM, keyPEM = generateCert(t, "gitlab.box.local", "*.gitlab.box.local")
+	assert.Nil(t, c.Set("apps/gitlab/ssl/pem", certPEM))
+	assert.Nil(t, c.Set("apps/gitlab/ssl/key", keyPEM))
+
+	assert.Nil(t, store.reload([]string{"gitlab", "owncloud"}))
+	assert.Equal(t, []string{"gitlab.box.local", "*.gitlab.box.local"}, servedNames(t, store, "GitLab.box.local"))
+	assert.Equal(t, []string{"gitlab.box.local", "*.gitlab.box.local"}, servedNames(t, store, "www.gitlab.box.local"))
+	assert.Equal(t, []string{"box.local"}, servedNames(t, store, "owncloud.box.local"))
+	assert.Equal(t, []string{"box.local"}, servedNames(t, store, ""))
+
+	// a rotated certificate is served after reloading
+	certPEM, keyPEM = generateCert(t, "gitlab.box.local")
+	assert.Nil(t, c.Set("apps/gitlab/ssl/pem", certPEM))
+	assert.Nil(t, c.Set("apps/gitlab/ssl/key", keyPEM))
+	assert.Nil(t, store.reload([]string{"gitlab"}))
+	assert.Equal(t, []string{"gitlab.box.local"}, servedNames(t, store, "gitlab.box.local"))
+	assert.Equal(t, []string{"box.local"}, servedNames(t, store, "www.gitlab.box.local"))
+
+	// an invalid certificate doesn't replace the previous one
+	assert.Nil(t, c.Set("apps/gitlab/ssl/key", "foo"))
+	assert.NotNil(t, store.reload([]string{"gitlab"}))
+	assert.Equal(t, []string{"gitlab.box.local"}, servedNames(t, store, "gitlab.box.local"))
+}
+
+func TestCertStoreACMECerts(t *testing.T) {
+	store, c := newTestCertStore(t)
+	certPEM, keyPEM := generateCert(t, "box.local")
+	assert.Nil(t, c.Set("ssl/pem", certPEM))
+	assert.Nil(t, c.Set("ssl/key", keyPEM))
+	certPEM, keyPEM = generateCert(t, "gitlab.example.com", "gitlab.box.local")
+	assert.Nil(t, c.Set("apps/gitlab/ssl/pem", certPEM))
+	assert.Nil(t, c.Set("apps/gitlab/ssl/key", keyPEM))
+	certPEM, keyPEM = generateCert(t, "gitlab.box.local", "ci.gitlab.box.local")
+	assert.Nil(t, c.Set("apps/gitlab/acme/pem", certPEM))
+	assert.Nil(t, c.Set("apps/gitlab/acme/key", keyPEM))
+	assert.Nil(t, store.reload([]string{"gitlab"}))
+
+	// the app's own certificate wins where both apply
+	assert.Equal(t, []string{"gitlab.example.com", "gitlab.box.local"}, servedNames(t, store, "gitlab.box.local"))
+	assert.Equal(t, []string{"gitlab.box.local", "ci.gitlab.box.local"}, servedNames(t, store, "ci.gitlab.box.local"))
+	assert.Equal(t, []string{"gitlab.box.local", "ci.gitlab.box.local"}, store.acmeCertificate("gitlab").DNSNames)
+}
+
+func TestCertStoreKeepsCertsWhenSKVSFails(t *testing.T) {
+	testDataPath, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	skvsHandler := server.NewServerHandler(testDataPath, nil, nil)
+	var failing int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		skvsHandler.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	c := client.NewFromURL(srv.URL)
+	store, err := newCertStore(c)
+	assert.Nil(t, err)
+
+	certPEM, keyPEM := generateCert(t, "box.local")
+	assert.Nil(t, c.Set("ssl/pem", certPEM))
+	assert.Nil(t, c.Set("ssl/key", keyPEM))
+	certPEM, keyPEM = generateCert(t, "gitlab.box.local")
+	assert.Nil(t, c.Set("apps/gitlab/ssl/pem", certPEM))
+	assert.Nil(t, c.Set("apps/gitlab/ssl/key", keyPEM))
+	caPEM, _ := generateCert(t, "Box CA")
+	assert.Nil(t, c.Set(clientCAName, caPEM))
+	assert.Nil(t, store.reload([]string{"gitlab"}))
+
+	// failed reads aren't missing certificates
+	atomic.StoreInt32(&failing, 1)
+	assert.NotNil(t, store.reload([]string{"gitlab"}))
+	assert.Equal(t, []string{"gitlab.box.local"}, servedNames(t, store, "gitlab.box.local"))
+	assert.Equal(t, []string{"box.local"}, servedNames(t, store, "owncloud.box.local"))
+	assert.NotNil(t, store.clientCAs)
+}
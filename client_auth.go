@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/experimental-platform/platform-central-gateway/proxy"
+)
+
+// clientCAName is the SKVS key of the box CA, whose certificates
+// are accepted from clients of routes with 'client_certificate'.
+const clientCAName = "ssl/client_ca"
+
+// loadClientCAs reads the box CA from SKVS, nil if there is none.
+func (s *certStore) loadClientCAs() (*x509.CertPool, string, error) {
+	pemData, err := s.client.Get(clientCAName)
+	if skvsNotFound(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(pemData)) {
+		return nil, "", errors.New("no certificate found")
+	}
+	return pool, pemData, nil
+}
+
+// verifyClient checks the certificate a client presented against the box CA and
+// returns the connection state with the verified chains, like the TLS stack does
+// for listeners requiring client certificates.
+func (s *certStore) verifyClient(state *tls.ConnectionState) (*tls.ConnectionState, error) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil, errors.New("no client certificate")
+	}
+
+	s.mutex.RLock()
+	roots := s.clientCAs
+	s.mutex.RUnlock()
+	if roots == nil {
+		return nil, fmt.Errorf("no client CA at '%s'", clientCAName)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	verified := *state
+	verified.VerifiedChains = chains
+	return &verified, nil
+}
+
+// requiresClientCert tells whether any route of a server name asks for client certificates.
+func (hpm *hostToProxyMap) requiresClientCert(serverName string) bool {
+	hpm.mutex.RLock()
+	defer hpm.mutex.RUnlock()
+
+	for _, pattern := range append(hostPatterns(normalizeHost(serverName)), "") {
+		for _, route := range hpm.pathRoutes[pattern] {
+			if route.tlsPolicy.clientCert {
+				return true
+			}
+		}
+		if route, ok := hpm.actualMap[pattern].(*appRoute); ok && route.tlsPolicy.clientCert {
+			return true
+		}
+	}
+	return false
+}
+
+// configureClientAuth has TLS clients of routes requiring client certificates send
+// theirs. Verification is left to the routes, so failures get an error page
+// instead of a broken handshake.
+func configureClientAuth(config *tls.Config, hpm *hostToProxyMap) {
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if !hpm.requiresClientCert(hello.ServerName) {
+			return nil, nil
+		}
+		clientAuth := config.Clone()
+		clientAuth.ClientAuth = tls.RequestClientCert
+		return clientAuth, nil
+	}
+}
+
+// requireClientCert answers requests without a client certificate signed by the
+// box CA with 403 and returns nil, else the request with the verified chains.
+func requireClientCert(w http.ResponseWriter, req *http.Request) *http.Request {
+	state, err := gatewayCerts.verifyClient(req.TLS)
+	if err != nil {
+		log.Infof("Refusing client certificate of %s for %s: %s", req.RemoteAddr, req.Host, err.Error())
+		proxy.WriteErrorPage(w, http.StatusForbidden)
+		return nil
+	}
+
+	verified := *req
+	verified.TLS = state
+	return &verified
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/experimental-platform/platform-central-gateway/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+// generateClientCert creates a CA and a client certificate signed by it,
+// returning the CA in PEM format and the client certificate.
+func generateClientCert(t *testing.T, subject string) (string, tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "box CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.Nil(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	assert.Nil(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: subject, Organization: []string{"protonet"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	assert.Nil(t, err)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})),
+		tls.Certificate{Certificate: [][]byte{certDER}, PrivateKey: key}
+}
+
+func newClientAuthCertStore(t *testing.T, caPEM string) *certStore {
+	store, c := newTestCertStore(t)
+	certPEM, keyPEM := generateCert(t, "box.local")
+	assert.Nil(t, c.Set("ssl/pem", certPEM))
+	assert.Nil(t, c.Set("ssl/key", keyPEM))
+	if caPEM != "" {
+		assert.Nil(t, c.Set(clientCAName, caPEM))
+	}
+	assert.Nil(t, store.reload(nil))
+	return store
+}
+
+func TestVerifyClient(t *testing.T) {
+	caPEM, clientCert := generateClientCert(t, "device-1")
+	leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	assert.Nil(t, err)
+	_, otherCert := generateClientCert(t, "device-2")
+	otherLeaf, err := x509.ParseCertificate(otherCert.Certificate[0])
+	assert.Nil(t, err)
+
+	// without a CA no client is accepted
+	store := newClientAuthCertStore(t, "")
+	_, err = store.verifyClient(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}})
+	assert.NotNil(t, err)
+
+	store = newClientAuthCertStore(t, caPEM)
+	_, err = store.verifyClient(nil)
+	assert.NotNil(t, err)
+	_, err = store.verifyClient(&tls.ConnectionState{})
+	assert.NotNil(t, err)
+	_, err = store.verifyClient(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{otherLeaf}})
+	assert.NotNil(t, err)
+
+	state, err := store.verifyClient(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}})
+	assert.Nil(t, err)
+	assert.Equal(t, "device-1", state.VerifiedChains[0][0].Subject.CommonName)
+}
+
+func TestRequiresClientCert(t *testing.T) {
+	hpm := &hostToProxyMap{
+		actualMap: map[string]http.Handler{
+			"gitlab.box.local": &appRoute{tlsPolicy: tlsPolicy{clientCert: true}},
+			"box.local":        &appRoute{},
+		},
+		pathRoutes: map[string][]*pathRoute{
+			"*.internal.box.local": {{PathPrefix: "/admin/", tlsPolicy: tlsPolicy{clientCert: true}}},
+		},
+	}
+
+	assert.True(t, hpm.requiresClientCert("GitLab.box.local"))
+	assert.True(t, hpm.requiresClientCert("metrics.internal.box.local"))
+	assert.False(t, hpm.requiresClientCert("box.local"))
+	assert.False(t, hpm.requiresClientCert(""))
+}
+
+func TestClientCertRoute(t *testing.T) {
+	caPEM, clientCert := generateClientCert(t, "device-1")
+	defer func(certs *certStore) { gatewayCerts = certs }(gatewayCerts)
+	gatewayCerts = newClientAuthCertStore(t, caPEM)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Header.Get(proxy.ClientSubjectHeader)))
+	}))
+	defer backend.Close()
+
+	settings, err := proxyOptions{ClientCertificate: true}.build()
+	assert.Nil(t, err)
+	route, err := newPathRoute("internal.box.local", "/", false, backend.URL, settings)
+	assert.Nil(t, err)
+	hpm := &hostToProxyMap{actualMap: map[string]http.Handler{}}
+	hpm.setPathRoutes([]*pathRoute{route})
+
+	gateway := httptest.NewUnstartedServer(route)
+	gateway.TLS = &tls.Config{GetCertificate: gatewayCerts.getCertificate}
+	configureClientAuth(gateway.TLS, hpm)
+	gateway.StartTLS()
+	defer gateway.Close()
+
+	get := func(certs ...tls.Certificate) (int, string) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			ServerName:         "internal.box.local",
+			InsecureSkipVerify: true,
+			Certificates:       certs,
+		}}}
+		req, _ := http.NewRequest("GET", gateway.URL, nil)
+		req.Header.Set(proxy.ClientSubjectHeader, "CN=spoofed")
+		resp, err := client.Do(req)
+		if !assert.Nil(t, err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, subject := get(clientCert)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "CN=device-1,O=protonet", subject)
+
+	status, _ = get()
+	assert.Equal(t, http.StatusForbidden, status)
+
+	_, otherCert := generateClientCert(t, "device-2")
+	status, _ = get(otherCert)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// plain HTTP can't pass as HTTPS
+	req := httptest.NewRequest("GET", "http://internal.box.local/", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	route.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
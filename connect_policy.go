@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	skvs "github.com/experimental-platform/platform-skvs/client"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const connectDialTimeout = 10 * time.Second
+
+// connectRuleConfig allows CONNECT tunnels to targets matching a 'HOST:PORT' pattern
+// and sends them to a local service instead. HOST may be '*' or a wildcard like
+// '*.box.local', PORT may be '*'. Rules are given with -connect or in the route file:
+//
+//	connect:
+//	  - target: "*:22"
+//	    service: 127.0.0.1:22
+//	    users: [admin]
+type connectRuleConfig struct {
+	Target  string `yaml:"target" json:"target"`
+	Service string `yaml:"service" json:"service"`
+	// users allowed to use the rule, any authenticated user if empty
+	Users []string `yaml:"users" json:"users,omitempty"`
+}
+
+type connectRule struct {
+	// the pattern as configured
+	target     string
+	host, port string
+	service    string
+	users      map[string]bool
+}
+
+func (c connectRuleConfig) build() (*connectRule, error) {
+	host, port, err := net.SplitHostPort(c.Target)
+	if err != nil {
+		return nil, fmt.Errorf("CONNECT target '%s': %s", c.Target, err.Error())
+	}
+	if _, _, err := net.SplitHostPort(c.Service); err != nil {
+		return nil, fmt.Errorf("CONNECT service '%s': %s", c.Service, err.Error())
+	}
+
+	rule := &connectRule{target: c.Target, host: normalizeHost(host), port: port, service: c.Service}
+	if len(c.Users) > 0 {
+		rule.users = make(map[string]bool)
+		for _, user := range c.Users {
+			rule.users[user] = true
+		}
+	}
+	return rule, nil
+}
+
+// parseConnectSpec parses a rule given on the command line as "TARGET=SERVICE",
+// e.g. "*:22=127.0.0.1:22".
+func parseConnectSpec(spec string) (*connectRule, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("CONNECT rule '%s' has to be 'TARGET=SERVICE'", spec)
+	}
+	return connectRuleConfig{Target: parts[0], Service: parts[1]}.build()
+}
+
+func (r *connectRule) matches(host, port string) bool {
+	if r.port != "*" && r.port != port {
+		return false
+	}
+	if r.host == "*" {
+		return true
+	}
+	for _, pattern := range hostPatterns(host) {
+		if pattern == r.host {
+			return true
+		}
+	}
+	return false
+}
+
+// connectPolicy decides which CONNECT requests are tunnelled where. Clients have
+// to authenticate with Proxy-Authorization: Basic, the bcrypt hashes of the
+// passwords are read from SKVS at 'connect/users/<name>'.
+type connectPolicy struct {
+	client *skvs.Client
+	// of the tunnels, zero means none
+	idleTimeout time.Duration
+
+	mutex sync.RWMutex
+	rules []*connectRule
+}
+
+func newConnectPolicy(client *skvs.Client) (*connectPolicy, error) {
+	if client == nil {
+		var err error
+		if client, err = skvs.NewFromDocker(); err != nil {
+			return nil, fmt.Errorf("newConnectPolicy: %s", err.Error())
+		}
+	}
+
+	return &connectPolicy{client: client}, nil
+}
+
+// setRules replaces the rules, the first matching rule wins.
+func (p *connectPolicy) setRules(rules []*connectRule) {
+	p.mutex.Lock()
+	p.rules = rules
+	p.mutex.Unlock()
+}
+
+// match finds the rule for a CONNECT target, nil if there is none.
+func (p *connectPolicy) match(target string) *connectRule {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil
+	}
+	host = normalizeHost(host)
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, rule := range p.rules {
+		if rule.matches(host, port) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// authenticate checks the Proxy-Authorization credentials of a request
+// and returns the user name.
+func (p *connectPolicy) authenticate(req *http.Request) (string, error) {
+	// BasicAuth only looks at the Authorization header
+	credentials := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+	user, password, ok := credentials.BasicAuth()
+	if !ok {
+		return "", errors.New("no credentials")
+	}
+	if user == "" || strings.Contains(user, "/") || strings.HasPrefix(user, ".") {
+		return "", fmt.Errorf("invalid user name '%s'", user)
+	}
+
+	hash, err := p.client.Get("connect/users/" + user)
+	if err != nil {
+		return "", fmt.Errorf("unknown user '%s'", user)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return "", fmt.Errorf("wrong password of '%s'", user)
+	}
+	return user, nil
+}
+
+// refuseConnect answers a CONNECT request which won't be tunnelled.
+func refuseConnect(w http.ResponseWriter, status int) {
+	if status == http.StatusProxyAuthRequired {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="central-gateway"`)
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// wrap answers CONNECT requests, everything else is passed on to next.
+func (p *connectPolicy) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "CONNECT" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		p.serveConnect(w, req)
+	})
+}
+
+// serveConnect authenticates the client, checks its target against the rules
+// and tunnels the connection to the rule's service. Everything else is refused
+// with 407, 403, 502 or, for HTTP/2 clients, 505.
+func (p *connectPolicy) serveConnect(w http.ResponseWriter, req *http.Request) {
+	target := req.Host
+	user, err := p.authenticate(req)
+	if err != nil {
+		log.Infof("Refusing CONNECT to %s from %s: %s", target, req.RemoteAddr, err.Error())
+		refuseConnect(w, http.StatusProxyAuthRequired)
+		return
+	}
+
+	rule := p.match(target)
+	if rule == nil || rule.users != nil && !rule.users[user] {
+		log.Infof("Refusing CONNECT to %s from %s (%s): not allowed", target, req.RemoteAddr, user)
+		refuseConnect(w, http.StatusForbidden)
+		return
+	}
+
+	// HTTP/2 streams can't be taken over, and wrapped writers may still claim to be Hijackers
+	hijacker, ok := w.(http.Hijacker)
+	if !ok || req.ProtoMajor != 1 {
+		refuseConnect(w, http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	service, err := net.DialTimeout("tcp", rule.service, connectDialTimeout)
+	if err != nil {
+		log.Errorf("CONNECT to %s from %s (%s): %s", target, req.RemoteAddr, user, err.Error())
+		refuseConnect(w, http.StatusBadGateway)
+		return
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		log.Errorf("CONNECT to %s from %s (%s): %s", target, req.RemoteAddr, user, err.Error())
+		service.Close()
+		refuseConnect(w, http.StatusInternalServerError)
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		conn.Close()
+		service.Close()
+		return
+	}
+
+	log.Infof("Tunnelling CONNECT to %s from %s (%s) to %s", target, req.RemoteAddr, user, rule.service)
+	start := time.Now()
+	// the client may have sent data right after its request
+	stats := tunnel(&bufferedConn{Conn: conn, reader: buf.Reader}, service, p.idleTimeout)
+	recordTunnel("connect:"+rule.target, stats)
+	log.Infof("Closed CONNECT tunnel to %s from %s (%s) after %s: %d bytes sent, %d received",
+		target, req.RemoteAddr, user, time.Since(start), stats.up, stats.down)
+}
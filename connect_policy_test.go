@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/http2"
+
+	"github.com/experimental-platform/platform-skvs/client"
+	"github.com/experimental-platform/platform-skvs/server"
+)
+
+func TestConnectRules(t *testing.T) {
+	policy := &connectPolicy{}
+	var rules []*connectRule
+	for _, spec := range []string{"ssh.box.local:22=127.0.0.1:22", "*.box.local:*=127.0.0.1:8022", "*:443=127.0.0.1:4443"} {
+		rule, err := parseConnectSpec(spec)
+		assert.Nil(t, err)
+		rules = append(rules, rule)
+	}
+	policy.setRules(rules)
+
+	for target, service := range map[string]string{
+		"SSH.box.local:22":  "127.0.0.1:22",
+		"git.box.local:22":  "127.0.0.1:8022",
+		"box.local:443":     "127.0.0.1:4443",
+		"example.com:443":   "127.0.0.1:4443",
+		"[2001:db8::1]:443": "127.0.0.1:4443",
+	} {
+		if rule := policy.match(target); assert.NotNil(t, rule, target) {
+			assert.Equal(t, service, rule.service, target)
+		}
+	}
+	for _, target := range []string{"box.local:22", "example.com:80", "example.com"} {
+		assert.Nil(t, policy.match(target), target)
+	}
+
+	for _, spec := range []string{"*:22", "*=127.0.0.1:22", "*:22=localhost"} {
+		_, err := parseConnectSpec(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+// startEchoServer accepts TCP connections and echoes whatever it receives.
+func startEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func newTestConnectPolicy(t *testing.T) *connectPolicy {
+	testDataPath, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	c := client.NewFromURL(httptest.NewServer(server.NewServerHandler(testDataPath, nil, nil)).URL)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Set("connect/users/admin", string(hash)))
+	assert.Nil(t, c.Set("connect/users/guest", string(hash)))
+
+	policy, err := newConnectPolicy(c)
+	assert.Nil(t, err)
+	return policy
+}
+
+// connect sends a CONNECT request and returns the response and the connection.
+func connect(t *testing.T, gateway, target, user string) (*http.Response, net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", gateway)
+	assert.Nil(t, err)
+
+	request := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if user != "" {
+		request += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user)) + "\r\n"
+	}
+	_, err = conn.Write([]byte(request + "\r\n"))
+	assert.Nil(t, err)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	assert.Nil(t, err)
+	return resp, conn, reader
+}
+
+func TestConnectPolicy(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+
+	policy := newTestConnectPolicy(t)
+	ssh, _ := connectRuleConfig{Target: "ssh.box.local:22", Service: echo.Addr().String(), Users: []string{"admin"}}.build()
+	wildcard, _ := connectRuleConfig{Target: "*.box.local:7", Service: echo.Addr().String()}.build()
+	down, _ := connectRuleConfig{Target: "down.box.local:22", Service: closed.Addr().String()}.build()
+	policy.setRules([]*connectRule{ssh, wildcard, down})
+
+	gateway := httptest.NewServer(createProxy(policy))
+	defer gateway.Close()
+	addr := gateway.Listener.Addr().String()
+
+	for _, test := range []struct {
+		target, user string
+		status       int
+	}{
+		{"ssh.box.local:22", "", http.StatusProxyAuthRequired},
+		{"ssh.box.local:22", "admin:wrong", http.StatusProxyAuthRequired},
+		{"ssh.box.local:22", "nobody:secret", http.StatusProxyAuthRequired},
+		{"ssh.box.local:22", "../admin:secret", http.StatusProxyAuthRequired},
+		{"ssh.box.local:22", "guest:secret", http.StatusForbidden},
+		{"example.com:22", "admin:secret", http.StatusForbidden},
+		{"down.box.local:22", "admin:secret", http.StatusBadGateway},
+	} {
+		resp, conn, _ := connect(t, addr, test.target, test.user)
+		assert.Equal(t, test.status, resp.StatusCode, test.target+" "+test.user)
+		if test.status == http.StatusProxyAuthRequired {
+			assert.Equal(t, `Basic realm="central-gateway"`, resp.Header.Get("Proxy-Authenticate"))
+		}
+		conn.Close()
+	}
+
+	for _, test := range []struct{ target, user string }{
+		{"ssh.box.local:22", "admin:secret"},
+		{"git.box.local:7", "guest:secret"},
+	} {
+		resp, conn, reader := connect(t, addr, test.target, test.user)
+		assert.Equal(t, "200 Connection established", resp.Status)
+		conn.Write([]byte("ping\n"))
+		line, err := reader.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "ping\n", line)
+		conn.Close()
+	}
+}
+
+func TestConnectPolicyHTTP2(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	policy := newTestConnectPolicy(t)
+	ssh, _ := connectRuleConfig{Target: "ssh.box.local:22", Service: echo.Addr().String()}.build()
+	policy.setRules([]*connectRule{ssh})
+
+	// the access log's writer can hijack, which the HTTP/2 stream below it can't
+	accessLog, err := newAccessLog("stdout", "combined")
+	assert.Nil(t, err)
+	url, stop := startTLSServer(t, accessLog.wrap(createProxy(policy)), true)
+	defer stop()
+
+	client := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	req, _ := http.NewRequest("CONNECT", url, nil)
+	req.Host = "ssh.box.local:22"
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:secret")))
+	resp, err := client.Do(req)
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, "HTTP/2.0", resp.Proto)
+		assert.Equal(t, http.StatusHTTPVersionNotSupported, resp.StatusCode)
+	}
+}
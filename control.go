@@ -5,29 +5,71 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func getControlHandler() http.Handler {
 	router := mux.NewRouter()
 	router.HandleFunc("/reload-proxies", func(w http.ResponseWriter, req *http.Request) {
 		_, err := gatewayAppMap.reload()
-		if err != nil {
+		if _, ok := err.(reloadError); !ok && err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+
+		writeAppStatus(w)
 	}).Methods("POST")
 
+	router.HandleFunc("/reload-certificates", func(w http.ResponseWriter, req *http.Request) {
+		if err := gatewayCerts.reload(gatewayAppRegistry.list()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}).Methods("POST")
+
+	router.HandleFunc("/apps/status", func(w http.ResponseWriter, req *http.Request) {
+		writeAppStatus(w)
+	}).Methods("GET")
+
+	router.HandleFunc("/apps/refresh", func(w http.ResponseWriter, req *http.Request) {
+		if events := gatewayAppRegistry.refresh(); len(events) > 0 {
+			saveAppList(gatewayAppRegistry.list())
+		}
+	}).Methods("POST")
+
+	router.HandleFunc("/health", func(w http.ResponseWriter, req *http.Request) {
+		data, err := json.Marshal(gatewayAppMap.health())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}).Methods("GET")
+
+	router.HandleFunc("/routes", func(w http.ResponseWriter, req *http.Request) {
+		data, err := json.Marshal(gatewayAppMap.listPathRoutes())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}).Methods("GET")
+
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
 	router.HandleFunc("/reload-app-networking", func(w http.ResponseWriter, req *http.Request) {
 
 	})
 
-	// TODO use an actual dynamic application list
-	// that will be possible once app installer arrives
 	router.HandleFunc("/apps/", func(w http.ResponseWriter, req *http.Request) {
-		apps := getAppMacvlanMap()
+		apps := gatewayAppRegistry.list()
 		data, err := json.Marshal(apps)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -81,3 +123,14 @@ func getControlHandler() http.Handler {
 
 	return router
 }
+
+func writeAppStatus(w http.ResponseWriter) {
+	data, err := json.Marshal(gatewayAppMap.status())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/events"
+	"github.com/docker/engine-api/types/filters"
+)
+
+const soulNginxContainer = "soul-nginx"
+
+// switchingHandler is an http.Handler whose target can be replaced at runtime.
+type switchingHandler struct {
+	handler http.Handler
+	mutex   sync.RWMutex
+}
+
+func (s *switchingHandler) set(handler http.Handler) {
+	s.mutex.Lock()
+	s.handler = handler
+	s.mutex.Unlock()
+}
+
+func (s *switchingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.RLock()
+	handler := s.handler
+	s.mutex.RUnlock()
+
+	handler.ServeHTTP(w, req)
+}
+
+// watchDockerEvents streams container and network events from the Docker engine
+// to handle until the stream ends or ctx is cancelled.
+func watchDockerEvents(ctx context.Context, handle func(events.Message)) error {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return err
+	}
+
+	eventFilter := filters.NewArgs()
+	eventFilter.Add("type", events.ContainerEventType)
+	eventFilter.Add("type", events.NetworkEventType)
+
+	body, err := cli.Events(ctx, types.EventsOptions{Filters: eventFilter})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	decoder := json.NewDecoder(body)
+	for {
+		var msg events.Message
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		handle(msg)
+	}
+}
+
+// runDockerEventWatcher keeps the Docker event stream open until stop is closed,
+// reconnecting after the Docker daemon went away.
+func runDockerEventWatcher(stop chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	for {
+		err := watchDockerEvents(ctx, handleDockerEvent)
+		select {
+		case _ = <-stop:
+			return
+		default:
+		}
+
+		if err != nil {
+			log.Errorf("Docker event stream failed: %s", err.Error())
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// containerNameOfEvent returns the name of the container an event refers to.
+func containerNameOfEvent(msg events.Message) string {
+	switch msg.Type {
+	case events.ContainerEventType:
+		return msg.Actor.Attributes["name"]
+	case events.NetworkEventType:
+		if msg.Actor.Attributes["name"] != "protonet" {
+			return ""
+		}
+
+		cli, err := client.NewEnvClient()
+		if err != nil {
+			log.Errorf("containerNameOfEvent(): %s", err.Error())
+			return ""
+		}
+
+		data, err := cli.ContainerInspect(context.Background(), msg.Actor.Attributes["container"])
+		if err != nil {
+			log.Errorf("containerNameOfEvent(): %s", err.Error())
+			return ""
+		}
+
+		return strings.TrimPrefix(data.Name, "/")
+	}
+
+	return ""
+}
+
+// handleDockerEvent rebuilds the proxies affected by a container (re)start,
+// stop or network change.
+func handleDockerEvent(msg events.Message) {
+	switch msg.Action {
+	case "start", "die", "destroy", "rename", "connect", "disconnect":
+	default:
+		return
+	}
+
+	containerName := containerNameOfEvent(msg)
+	if containerName == "" {
+		return
+	}
+
+	if containerName == soulNginxContainer {
+		if msg.Action == "die" || msg.Action == "destroy" || msg.Action == "disconnect" {
+			return
+		}
+
+		log.Infof("Container '%s' changed (%s), recreating default backend", containerName, msg.Action)
+		backend, err := createSwitchingProxyToContainer(soulNginxContainer, 80)
+		if err != nil {
+			log.Errorf("Failed to recreate default backend: %s", err.Error())
+			return
+		}
+		soulNginxProxy.set(backend)
+		return
+	}
+
+	// new or removed app containers show up in the registry
+	// which in turn adds or removes their routes
+	if _, ok := msg.Actor.Attributes[appLabel]; ok && (msg.Action == "start" || msg.Action == "destroy") {
+		if changes := gatewayAppRegistry.refresh(); len(changes) > 0 {
+			saveAppList(gatewayAppRegistry.list())
+			return
+		}
+	}
+
+	appName := msg.Actor.Attributes[appLabel]
+	if appName == "" {
+		appName = containerName
+	}
+
+	for _, knownApp := range gatewayAppRegistry.list() {
+		if knownApp != appName {
+			continue
+		}
+
+		log.Infof("Container of app '%s' changed (%s), rebuilding its routes", appName, msg.Action)
+		gatewayAppMap.updateApp(appName)
+		return
+	}
+}
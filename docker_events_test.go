@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/docker/engine-api/types/events"
+	"github.com/stretchr/testify/assert"
+)
+
+var testEvents = []events.Message{
+	{Type: events.ContainerEventType, Action: "start", Actor: events.Actor{ID: "ff08c45d1a40", Attributes: map[string]string{"name": "someapp"}}},
+	{Type: events.ContainerEventType, Action: "die", Actor: events.Actor{ID: "ff08c45d1a40", Attributes: map[string]string{"name": "someapp"}}},
+}
+
+func TestWatchDockerEvents(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/v1.22/events", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		encoder := json.NewEncoder(rw)
+		for _, msg := range testEvents {
+			encoder.Encode(msg)
+		}
+	}))
+	testserver := httptest.NewServer(mux)
+	defer testserver.Close()
+	os.Setenv("DOCKER_HOST", testserver.URL)
+
+	var received []events.Message
+	err := watchDockerEvents(context.Background(), func(msg events.Message) {
+		received = append(received, msg)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, testEvents, received)
+}
+
+func TestContainerNameOfEvent(t *testing.T) {
+	assert.Equal(t, "someapp", containerNameOfEvent(testEvents[0]))
+
+	otherNetwork := events.Message{Type: events.NetworkEventType, Action: "connect", Actor: events.Actor{Attributes: map[string]string{"name": "bridge", "container": "ff08c45d1a40"}}}
+	assert.Equal(t, "", containerNameOfEvent(otherNetwork))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/experimental-platform/platform-central-gateway/proxy"
+)
+
+func startHealthCheck(handler http.Handler, check *proxy.HealthCheck) {
+	if p, ok := handler.(*proxy.Proxy); ok && check != nil {
+		p.StartHealthCheck(*check)
+	}
+}
+
+func stopHealthCheck(handler http.Handler) {
+	if p, ok := handler.(*proxy.Proxy); ok {
+		p.StopHealthCheck()
+	}
+}
+
+func backendStatus(handler http.Handler) []proxy.BackendStatus {
+	if p, ok := handler.(*proxy.Proxy); ok {
+		return p.Status()
+	}
+	return nil
+}
+
+// gatewayHealth is the backend state of all routes as reported by the control API.
+type gatewayHealth struct {
+	Apps   map[string][]proxy.BackendStatus `json:"apps"`
+	Routes map[string][]proxy.BackendStatus `json:"routes"`
+}
+
+func (hpm *hostToProxyMap) health() gatewayHealth {
+	hpm.mutex.RLock()
+	defer hpm.mutex.RUnlock()
+
+	result := gatewayHealth{
+		Apps:   make(map[string][]proxy.BackendStatus),
+		Routes: make(map[string][]proxy.BackendStatus),
+	}
+	for appName, route := range hpm.apps {
+		result.Apps[appName] = backendStatus(route.proxy)
+	}
+	for _, routes := range hpm.pathRoutes {
+		for _, route := range routes {
+			result.Routes[route.name()] = backendStatus(route.handler)
+		}
+	}
+
+	return result
+}
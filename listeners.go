@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// first file descriptor passed by systemd, see sd_listen_fds(3)
+const systemdFirstFd = 3
+
+// systemdListeners returns the sockets passed by systemd socket activation by
+// their FileDescriptorName, none if the gateway wasn't socket activated.
+func systemdListeners() (map[string][]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %s", err.Error())
+	}
+	return fdListeners(systemdFirstFd, count, os.Getenv("LISTEN_FDNAMES"))
+}
+
+// fdListeners turns count consecutive file descriptors into listeners, named by
+// the colon separated names. Unnamed sockets are called "unknown" like systemd does.
+func fdListeners(first, count int, names string) (map[string][]net.Listener, error) {
+	nameList := strings.Split(names, ":")
+	listeners := make(map[string][]net.Listener)
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(nameList) && nameList[i] != "" {
+			name = nameList[i]
+		}
+
+		file := os.NewFile(uintptr(first+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket '%s' passed by systemd: %s", name, err.Error())
+		}
+		listeners[name] = append(listeners[name], listener)
+	}
+	return listeners, nil
+}
+
+// listen opens the listeners of a comma separated list of addresses:
+// 'HOST:PORT' for TCP, e.g. '[::]:80', 'unix:PATH' for a unix socket or
+// 'systemd:NAME' for the sockets named so by socket activation.
+func listen(addrs string, activated map[string][]net.Listener) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		var listener net.Listener
+		var err error
+		switch {
+		case strings.HasPrefix(addr, "systemd:"):
+			socket := strings.TrimPrefix(addr, "systemd:")
+			if len(activated[socket]) == 0 {
+				err = errors.New("no such socket passed by systemd")
+				break
+			}
+			listeners = append(listeners, activated[socket]...)
+			continue
+		case strings.HasPrefix(addr, "unix:"):
+			path := strings.TrimPrefix(addr, "unix:")
+			// a socket left behind by a previous run
+			if info, statErr := os.Stat(path); statErr == nil && info.Mode()&os.ModeSocket != 0 {
+				os.Remove(path)
+			}
+			listener, err = net.Listen("unix", path)
+		default:
+			listener, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("listening at %s: %s", addr, err.Error())
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// connTracker keeps the connections accepted by the gateway's listeners. Unlike
+// http.Server it still knows about hijacked connections, e.g. websockets.
+type connTracker struct {
+	mutex sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]struct{})}
+}
+
+func (t *connTracker) count() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.conns)
+}
+
+func (t *connTracker) closeAll() {
+	t.mutex.Lock()
+	conns := make([]net.Conn, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.mutex.Unlock()
+
+	// closing removes them from the tracker
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// track adds a connection, which is removed again once it's closed.
+func (t *connTracker) track(conn net.Conn) net.Conn {
+	tracked := &trackedConn{Conn: conn, tracker: t}
+	t.mutex.Lock()
+	t.conns[tracked] = struct{}{}
+	t.mutex.Unlock()
+	return tracked
+}
+
+type trackingListener struct {
+	net.Listener
+	tracker *connTracker
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return l.tracker.track(conn), nil
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.tracker.mutex.Lock()
+		delete(c.tracker.conns, c)
+		c.tracker.mutex.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func (c *trackedConn) CloseWrite() error {
+	return closeWrapped(c.Conn)
+}
+
+// serverGroup runs the gateway's servers and shuts them down together.
+type serverGroup struct {
+	servers []*http.Server
+	conns   *connTracker
+	// the first error of a server which stopped serving
+	errors chan error
+}
+
+func newServerGroup() *serverGroup {
+	return &serverGroup{conns: newConnTracker(), errors: make(chan error, 1)}
+}
+
+// serve starts serving on the listeners, with TLS if the server has a TLS config.
+func (g *serverGroup) serve(server *http.Server, listeners []net.Listener) {
+	g.servers = append(g.servers, server)
+	for _, listener := range listeners {
+		log.Infof("Listening at %s", listener.Addr().String())
+
+		go func(listener net.Listener) {
+			tracked := &trackingListener{Listener: listener, tracker: g.conns}
+			var err error
+			if server.TLSConfig != nil {
+				err = server.ServeTLS(tracked, "", "")
+			} else {
+				err = server.Serve(tracked)
+			}
+			if err != http.ErrServerClosed {
+				select {
+				case g.errors <- fmt.Errorf("serving at %s: %s", listener.Addr().String(), err.Error()):
+				default:
+				}
+			}
+		}(listener)
+	}
+}
+
+// shutdown stops accepting connections and waits for in-flight requests and
+// hijacked connections like websockets to finish. Whatever is left at the
+// deadline is closed, which is reported as error.
+func (g *serverGroup) shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range g.servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			server.Shutdown(ctx)
+		}(server)
+	}
+	wg.Wait()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for ctx.Err() == nil && g.conns.count() > 0 {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+
+	if left := g.conns.count(); left > 0 {
+		for _, server := range g.servers {
+			server.Close()
+		}
+		g.conns.closeAll()
+		return fmt.Errorf("closed %d connections still open after %s", left, timeout)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "control.sock")
+
+	// a stale socket of a previous run is replaced
+	stale, err := net.Listen("unix", socket)
+	assert.Nil(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listeners, err := listen("127.0.0.1:0, unix:"+socket, nil)
+	assert.Nil(t, err)
+	if assert.Len(t, listeners, 2) {
+		assert.Equal(t, "tcp", listeners[0].Addr().Network())
+		assert.Equal(t, socket, listeners[1].Addr().String())
+	}
+	for _, listener := range listeners {
+		listener.Close()
+	}
+
+	_, err = listen("127.0.0.1:0,systemd:http", nil)
+	assert.NotNil(t, err)
+	_, err = listen("no-port", nil)
+	assert.NotNil(t, err)
+}
+
+// dupFd returns a copy of the descriptor of a file, owned by the caller like the ones passed by systemd.
+func dupFd(t *testing.T, file *os.File) int {
+	defer file.Close()
+	fd, err := syscall.Dup(int(file.Fd()))
+	assert.Nil(t, err)
+	return fd
+}
+
+func TestFdListeners(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	file, err := listener.(*net.TCPListener).File()
+	assert.Nil(t, err)
+
+	activated, err := fdListeners(dupFd(t, file), 1, "http")
+	assert.Nil(t, err)
+	listeners, err := listen("systemd:http", activated)
+	assert.Nil(t, err)
+	if assert.Len(t, listeners, 1) {
+		assert.Equal(t, listener.Addr().String(), listeners[0].Addr().String())
+		listeners[0].Close()
+	}
+
+	// not a socket
+	file, err = ioutil.TempFile("", "fd")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	_, err = fdListeners(dupFd(t, file), 1, "")
+	assert.NotNil(t, err)
+}
+
+// startServerGroup serves a handler at a random port.
+func startServerGroup(t *testing.T, handler http.Handler) (*serverGroup, string) {
+	listeners, err := listen("127.0.0.1:0", nil)
+	assert.Nil(t, err)
+	servers := newServerGroup()
+	servers.serve(newServer("", handler), listeners)
+	return servers, listeners[0].Addr().String()
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	servers, addr := startServerGroup(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}))
+
+	response := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if !assert.Nil(t, err) {
+			response <- ""
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		response <- string(body)
+	}()
+	<-started
+
+	stopped := make(chan error)
+	go func() { stopped <- servers.shutdown(5 * time.Second) }()
+
+	// no new connections are accepted while draining
+	time.Sleep(50 * time.Millisecond)
+	_, err := net.Dial("tcp", addr)
+	assert.NotNil(t, err)
+
+	select {
+	case <-stopped:
+		t.Fatal("shutdown didn't wait for the request")
+	default:
+	}
+
+	close(release)
+	assert.Equal(t, "done", <-response)
+	assert.Nil(t, <-stopped)
+}
+
+func TestShutdownClosesHijackedConnections(t *testing.T) {
+	servers, addr := startServerGroup(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		assert.Nil(t, err)
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n\r\n")
+		buf.Flush()
+		// like a websocket, kept open until either side closes it
+		ioutil.ReadAll(conn)
+		conn.Close()
+	}))
+
+	openConn := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		assert.Nil(t, err)
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: box.local\r\n\r\n"))
+		status, err := bufio.NewReader(conn).ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+		return conn
+	}
+
+	// closed by the client in time
+	go func(conn net.Conn) {
+		time.Sleep(200 * time.Millisecond)
+		conn.Close()
+	}(openConn())
+	assert.Nil(t, servers.shutdown(5*time.Second))
+
+	// still open at the deadline
+	servers, addr = startServerGroup(t, servers.servers[0].Handler)
+	conn := openConn()
+	defer conn.Close()
+	assert.NotNil(t, servers.shutdown(200*time.Millisecond))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, servers.conns.count())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/experimental-platform/platform-central-gateway/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	gatewayRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "requests_total",
+		Help:      "Requests served by route and status code.",
+	}, []string{"route", "code"})
+
+	gatewayRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gateway",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to serve requests by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route"})
+
+	gatewayRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gateway",
+		Name:      "requests_in_flight",
+		Help:      "Requests currently being served.",
+	})
+
+	gatewayReloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "reloads_total",
+		Help:      "Reloads of the app routes.",
+	})
+
+	gatewayReloadFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "reload_failures_total",
+		Help:      "Reloads of the app routes in which at least one app failed to load.",
+	})
+
+	gatewayReloadFailedApps = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gateway",
+		Name:      "reload_failed_apps",
+		Help:      "Apps which failed to load during the last reload.",
+	})
+
+	gatewayTunnelBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "tunnel_bytes_total",
+		Help:      "Bytes copied by closed tunnels by route and direction, 'up' is towards the service.",
+	}, []string{"route", "direction"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		gatewayRequests,
+		gatewayRequestDuration,
+		gatewayRequestsInFlight,
+		gatewayReloads,
+		gatewayReloadFailures,
+		gatewayReloadFailedApps,
+		gatewayTunnelBytes,
+	)
+}
+
+func appRouteName(appName string) string {
+	return "app:" + appName
+}
+
+// routeName identifies the route a handler serves in metrics and the access log.
+func routeName(handler http.Handler) string {
+	switch route := handler.(type) {
+	case *appRoute:
+		return appRouteName(route.name)
+	case *pathRoute:
+		return "route:" + route.name()
+	}
+	return soulNginxContainer
+}
+
+// serveInstrumented serves a request and records it in the request metrics.
+func serveInstrumented(handler http.Handler, w http.ResponseWriter, req *http.Request) {
+	gatewayRequestsInFlight.Inc()
+	defer gatewayRequestsInFlight.Dec()
+
+	route := routeName(handler)
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	handler.ServeHTTP(sw, req)
+
+	gatewayRequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	gatewayRequests.WithLabelValues(route, strconv.Itoa(sw.statusCode(req.Method))).Inc()
+}
+
+// recordReload updates the reload metrics with the apps which failed to load.
+func recordReload(failed reloadError) {
+	gatewayReloads.Inc()
+	gatewayReloadFailedApps.Set(float64(len(failed)))
+	if len(failed) > 0 {
+		gatewayReloadFailures.Inc()
+	}
+}
+
+// recordTunnel adds the bytes copied by a tunnel to the tunnel metrics.
+func recordTunnel(route string, stats tunnelStats) {
+	gatewayTunnelBytes.WithLabelValues(route, "up").Add(float64(stats.up))
+	gatewayTunnelBytes.WithLabelValues(route, "down").Add(float64(stats.down))
+}
+
+var backendHealthyDesc = prometheus.NewDesc(
+	"gateway_backend_healthy",
+	"Whether a backend of a route passes its health checks.",
+	[]string{"route", "backend"}, nil,
+)
+
+// backendHealthCollector reports the backend health of all routes when scraped,
+// so removed routes and backends disappear from the metrics right away.
+type backendHealthCollector struct {
+	hpm *hostToProxyMap
+}
+
+func (c backendHealthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backendHealthyDesc
+}
+
+func (c backendHealthCollector) Collect(ch chan<- prometheus.Metric) {
+	health := c.hpm.health()
+	for appName, backends := range health.Apps {
+		collectBackendHealth(ch, appRouteName(appName), backends)
+	}
+	for name, backends := range health.Routes {
+		collectBackendHealth(ch, "route:"+name, backends)
+	}
+}
+
+func collectBackendHealth(ch chan<- prometheus.Metric, route string, backends []proxy.BackendStatus) {
+	for _, backend := range backends {
+		healthy := 0.0
+		if backend.Healthy {
+			healthy = 1
+		}
+		ch <- prometheus.MustNewConstMetric(backendHealthyDesc, prometheus.GaugeValue, healthy, route, backend.URL)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/experimental-platform/platform-central-gateway/proxy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteName(t *testing.T) {
+	route, err := parseRouteSpec("box.local/devices/=http://127.0.0.1:9200")
+	assert.Nil(t, err)
+	assert.Equal(t, "route:box.local/devices/", routeName(route))
+	assert.Equal(t, "route:box.local/devices/", route.handler.(*proxy.Proxy).Name)
+	assert.Equal(t, "app:gitlab", routeName(&appRoute{name: "gitlab"}))
+	assert.Equal(t, soulNginxContainer, routeName(&testHandler{"other"}))
+}
+
+func TestServeInstrumented(t *testing.T) {
+	handler := &appRoute{name: "metrics-test", proxy: &testHandler{"hello"}}
+	before := testutil.ToFloat64(gatewayRequests.WithLabelValues("app:metrics-test", "200"))
+
+	serveInstrumented(handler, httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, before+1, testutil.ToFloat64(gatewayRequests.WithLabelValues("app:metrics-test", "200")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(gatewayRequestsInFlight))
+}
+
+func TestRecordReload(t *testing.T) {
+	failures := testutil.ToFloat64(gatewayReloadFailures)
+
+	recordReload(reloadError{"gitlab": fmt.Errorf("container gone")})
+	assert.Equal(t, 1.0, testutil.ToFloat64(gatewayReloadFailedApps))
+	assert.Equal(t, failures+1, testutil.ToFloat64(gatewayReloadFailures))
+
+	recordReload(nil)
+	assert.Equal(t, 0.0, testutil.ToFloat64(gatewayReloadFailedApps))
+	assert.Equal(t, failures+1, testutil.ToFloat64(gatewayReloadFailures))
+}
+
+func TestBackendHealthCollector(t *testing.T) {
+	backendURL, _ := url.Parse("http://10.0.0.1:80")
+	hpm := &hostToProxyMap{
+		apps: map[string]*appRoute{
+			"gitlab": {name: "gitlab", proxy: proxy.New(backendURL)},
+		},
+	}
+
+	expected := `
+# HELP gateway_backend_healthy Whether a backend of a route passes its health checks.
+# TYPE gateway_backend_healthy gauge
+gateway_backend_healthy{backend="http://10.0.0.1:80",route="app:gitlab"} 1
+`
+	err := testutil.CollectAndCompare(backendHealthCollector{hpm}, strings.NewReader(expected))
+	assert.Nil(t, err)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	rw := httptest.NewRecorder()
+	getControlHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), "gateway_reloads_total")
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,164 +24,507 @@ import (
 )
 
 type hostToProxyMap struct {
-	actualMap      map[string]http.Handler
-	mutex          sync.RWMutex
-	watcherStopper chan struct{}
-	watcherWG      sync.WaitGroup
+	actualMap  map[string]http.Handler
+	apps       map[string]*appRoute
+	pathRoutes map[string][]*pathRoute
+	// raw TCP and UDP ports of the apps, nil if not forwarded
+	streams *streamProxies
+	mutex   sync.RWMutex
 }
 
-func (hpm *hostToProxyMap) monitorAppExternalIP(appName string, interval time.Duration, stop chan struct{}, wg *sync.WaitGroup) {
-	defer wg.Done()
-	defer log.Infof("Stopped IP change monitor for app '%s'\n", appName)
-	lastKnownIP, err := getAppExternalIP(appName)
+// appRoute holds everything the gateway routes to a single app.
+// A route whose last update failed carries the error and
+// keeps serving its previous proxy, if there was one.
+type appRoute struct {
+	name            string
+	proxy           http.Handler
+	healthCheck     *proxy.HealthCheck
+	accessLogSample float64
+	tlsPolicy       tlsPolicy
+	hostName        string
+	extIP           string
+	// protonet IPs of the app's containers
+	appIPs         []string
+	streams        []streamPort
+	tlsPassthrough int
+	// PROXY protocol version sent with passed through connections
+	tlsPassthroughProxyProtocol int
+	// also route the subdomains of hostName
+	wildcardHost bool
+	err          error
+}
+
+func (r *appRoute) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	labelAccessLog(req, routeName(r), r.accessLogSample)
+	if req = r.tlsPolicy.apply(w, req); req == nil {
+		return
+	}
+	r.proxy.ServeHTTP(w, req)
+}
+
+func (r *appRoute) hosts() []string {
+	var hosts []string
+	if r.proxy == nil {
+		return hosts
+	}
+	if r.hostName != "" {
+		hostName := normalizeHost(r.hostName)
+		hosts = append(hosts, hostName)
+		if r.wildcardHost {
+			hosts = append(hosts, "*."+hostName)
+		}
+	}
+	if r.extIP != "" {
+		hosts = append(hosts, r.extIP)
+	}
+	return hosts
+}
+
+// updateAppExternalIP re-reads the macvlan IP of an app and updates its route.
+// A missing address only removes the IP route, the hostname stays reachable.
+func (hpm *hostToProxyMap) updateAppExternalIP(appName string) {
+	currentIP, err := getAppExternalIP(appName)
 	if err != nil {
-		log.Errorf("Failed to get external IP of app '%s': %s\ntherefore pp '%s' will not be monitored for IP changes", appName, err.Error(), appName)
+		log.Warningf("Failed to get external IP of app '%s': %s", appName, err.Error())
+		currentIP = ""
+	}
+
+	hpm.mutex.Lock()
+	defer hpm.mutex.Unlock()
+
+	route, ok := hpm.apps[appName]
+	if !ok || route.proxy == nil || route.extIP == currentIP {
+		return
+	}
+
+	log.Infof("IP of app '%s' changed '%s'->'%s'", appName, route.extIP, currentIP)
+	if route.extIP != "" {
+		delete(hpm.actualMap, route.extIP)
+	}
+	route.extIP = currentIP
+	hpm.streams.update(appName, currentIP, route.appIPs, route.streams)
+	if currentIP == "" {
 		return
 	}
+	hpm.actualMap[currentIP] = route
 
+	err = skvs.Set(fmt.Sprintf("apps/%s/last_macvlan_ip", appName), currentIP)
+	if err != nil {
+		log.Errorf("Error saving last external IP of '%s' to SKVS: %s", appName, err.Error())
+	}
+}
+
+// watchAppExternalIPs subscribes to netlink address updates and keeps the IP routes
+// of all apps in sync with their macvlan interfaces until stop is closed.
+func (hpm *hostToProxyMap) watchAppExternalIPs(stop chan struct{}) {
 	for {
+		updates := make(chan netlink.AddrUpdate)
+		done := make(chan struct{})
+		if err := netlink.AddrSubscribe(updates, done); err != nil {
+			log.Errorf("Failed to subscribe to address updates: %s", err.Error())
+		} else {
+			log.Infoln("Watching app interfaces for IP changes")
+			hpm.handleAddrUpdates(updates, stop)
+		}
+		close(done)
+
 		select {
 		case _ = <-stop:
 			return
-		default:
+		case _ = <-time.After(time.Second):
 		}
+	}
+}
 
-		currentIP, err := getAppExternalIP(appName)
-		if err != nil {
-			log.Errorf("Failed to get external IP of app '%s': %s\ntherefore pp '%s' will not be monitored for IP changes", appName, err.Error(), appName)
+// handleAddrUpdates processes address updates until the subscription breaks down.
+func (hpm *hostToProxyMap) handleAddrUpdates(updates chan netlink.AddrUpdate, stop chan struct{}) {
+	for {
+		select {
+		case _ = <-stop:
 			return
-		}
+		case update, ok := <-updates:
+			if !ok {
+				log.Warningln("Address update subscription closed, resubscribing")
+				return
+			}
 
-		if currentIP != lastKnownIP {
-			log.Infof("IP of app '%s' changed '%s'->'%s'. Reloading gateway config.", appName, lastKnownIP, currentIP)
-			go hpm.reload()
-			return
-		}
+			link, err := net.InterfaceByIndex(update.LinkIndex)
+			if err != nil {
+				// the interface might already be deleted
+				log.Debugf("Address update for unknown interface %d: %s", update.LinkIndex, err.Error())
+				continue
+			}
 
-		time.Sleep(interval)
+			if appName, ok := appNameFromIfName(link.Name); ok {
+				hpm.updateAppExternalIP(appName)
+			}
+		}
 	}
 }
 
-func (hpm *hostToProxyMap) stopAppExternalIPMonitoring() {
-	hpm.mutex.Lock()
-	defer hpm.mutex.Unlock()
-	if hpm.watcherStopper == nil {
-		return
+// buildAppRoutes creates the proxy of a single app
+// together with all hosts it should be reachable at.
+func buildAppRoutes(appName, boxName string) (*appRoute, error) {
+	ifName := appIfName(appName)
+	appIPs, err := getAppIP(appName)
+	if err != nil {
+		return nil, err
 	}
 
-	close(hpm.watcherStopper)
-	hpm.watcherStopper = nil
-	hpm.watcherWG.Wait()
-	log.Infof("All IP change monitors stopped.\n")
-}
-
-func (hpm *hostToProxyMap) startAppExternalIPMonitoring(apps []string) {
-	hpm.mutex.Lock()
-	defer hpm.mutex.Unlock()
+	var backends []*url.URL
+	for _, appIP := range appIPs {
+		url, err := url.Parse(fmt.Sprintf("http://%s:80/", appIP))
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, url)
+	}
 
-	if hpm.watcherStopper != nil {
-		log.Errorln("hostToProxyMap.startAppExternalIPMonitoring(): Trying to start app IP monitoring before stopping old monitoring!")
-		return
+	settings, err := getAppProxySettings(appName)
+	if err != nil {
+		return nil, err
+	}
+	streams, err := getAppStreams(appName)
+	if err != nil {
+		return nil, err
 	}
+	appProxy := settings.newProxy(appRouteName(appName), backends...)
+	appIP := strings.Join(appIPs, ", ")
 
-	hpm.watcherStopper = make(chan struct{})
+	ptwAddr := fmt.Sprintf("%s.%s.protonet.info", appName, boxName)
+	fmt.Printf("  %s => %s\n", ptwAddr, appIP)
 
-	for _, appName := range apps {
-		hpm.watcherWG.Add(1)
-		go hpm.monitorAppExternalIP(appName, 1000*time.Millisecond, hpm.watcherStopper, &hpm.watcherWG)
-		log.Infof("Added IP change monitor for app '%s'\n", appName)
-	}
-}
+	appInterface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		log.Warningf("buildAppRoutes(): interface '%s' doesn't exist - creating\n", ifName)
+		if err = createAppInterface(appName); err != nil {
+			log.Warningf("buildAppRoutes(): failed to create interface '%s': %s\n", ifName, err.Error())
+			return nil, err
+		}
 
-func getAppMacvlanMap() []string {
-	result := make([]string, 0)
-	if _, err := skvs.Get("gitlab/enabled"); err == nil {
-		result = append(result, "gitlab")
+		if appInterface, err = net.InterfaceByName(ifName); err != nil {
+			return nil, err
+		}
 	}
 
-	data, err := json.Marshal(&result)
+	extAppIP, err := getExtInterfaceIP(appInterface.Name)
 	if err != nil {
-		log.Errorf("Error saving application list to SKVS: %s", err.Error())
+		return nil, err
 	}
 
-	err = skvs.Set("applist", string(data))
+	err = skvs.Set(fmt.Sprintf("apps/%s/last_macvlan_ip", appName), extAppIP)
 	if err != nil {
-		log.Errorf("Error saving application list to SKVS: %s", err.Error())
+		log.Errorf("Error saving last external IP of '%s' to SKVS: %s", appName, err.Error())
 	}
 
-	return result
+	fmt.Printf("  %s => %s\n", extAppIP, appIP)
+
+	return &appRoute{
+		name:                        appName,
+		proxy:                       appProxy,
+		healthCheck:                 settings.healthCheck,
+		accessLogSample:             settings.accessLogSample,
+		tlsPolicy:                   settings.tlsPolicy,
+		hostName:                    ptwAddr,
+		extIP:                       extAppIP,
+		appIPs:                      appIPs,
+		streams:                     streams,
+		tlsPassthrough:              settings.tlsPassthrough,
+		tlsPassthroughProxyProtocol: settings.tlsPassthroughProxyProtocol,
+		wildcardHost:                settings.wildcardHost,
+	}, nil
 }
 
-func (hpm *hostToProxyMap) reload() (int, error) {
-	newMap := make(map[string]http.Handler)
-	boxName, err := skvs.Get("ptw/node_name")
-	if err != nil {
-		return 0, err
+// reloadError collects the apps which failed during a reload.
+type reloadError map[string]error
+
+func (e reloadError) Error() string {
+	names := make([]string, 0, len(e))
+	for appName := range e {
+		names = append(names, appName)
 	}
+	sort.Strings(names)
 
-	fmt.Println("new Host=>IP mapping:")
-	apps := getAppMacvlanMap()
+	messages := make([]string, 0, len(e))
+	for _, appName := range names {
+		messages = append(messages, fmt.Sprintf("%s: %s", appName, e[appName].Error()))
+	}
+	return "failed to load apps: " + strings.Join(messages, "; ")
+}
+
+// reload brings the map in line with the app registry. Apps failing to load are
+// reported in a reloadError and marked unhealthy, all other apps keep routing.
+func (hpm *hostToProxyMap) reload() (int, error) {
+	apps := gatewayAppRegistry.list()
+	listed := make(map[string]bool)
 	for _, appName := range apps {
-		ifName := appIfName(appName)
-		appIP, err := getAppIP(appName)
-		if err != nil {
-			return 0, err
+		listed[appName] = true
+	}
+
+	for _, appName := range hpm.appNames() {
+		if !listed[appName] {
+			hpm.removeApp(appName)
 		}
+	}
 
-		url, err := url.Parse(fmt.Sprintf("http://%s:80/", appIP))
-		if err != nil {
-			return 0, err
+	failed := make(reloadError)
+	for _, appName := range apps {
+		if err := hpm.updateApp(appName); err != nil {
+			failed[appName] = err
 		}
-		appProxy := proxy.New(url)
+	}
 
-		ptwAddr := fmt.Sprintf("%s.%s.protonet.info", appName, boxName)
-		newMap[ptwAddr] = appProxy
-		fmt.Printf("  %s => %s\n", ptwAddr, appIP)
+	hpm.mutex.RLock()
+	count := len(hpm.actualMap)
+	hpm.mutex.RUnlock()
 
-		appInterface, err := net.InterfaceByName(ifName)
-		if err != nil {
-			log.Warningf("hostToProxyMap.reload(): interface '%s' doesn't exist - creating\n", ifName)
-			if err = createAppInterface(appName); err != nil {
-				log.Warningf("hostToProxyMap.reload(): failed to create interface '%s': %s\n", ifName, err.Error())
-				return 0, err
-			}
+	recordReload(failed)
+	if len(failed) > 0 {
+		return count, failed
+	}
+	return count, nil
+}
 
-			if appInterface, err = net.InterfaceByName(ifName); err != nil {
-				return 0, err
-			}
-		}
+// appHostNames returns the hostnames of all routed apps by app name, except
+// those with TLS passthrough.
+func (hpm *hostToProxyMap) appHostNames() map[string]string {
+	hpm.mutex.RLock()
+	defer hpm.mutex.RUnlock()
 
-		extAppIP, err := getExtInterfaceIP(appInterface.Name)
-		if err != nil {
-			return 0, err
+	hostNames := make(map[string]string)
+	for appName, route := range hpm.apps {
+		// passthrough apps serve their own certificates
+		if route.proxy != nil && route.hostName != "" && route.tlsPassthrough == 0 {
+			hostNames[appName] = normalizeHost(route.hostName)
 		}
+	}
+	return hostNames
+}
 
-		err = skvs.Set(fmt.Sprintf("apps/%s/last_macvlan_ip", appName), extAppIP)
-		if err != nil {
-			log.Errorf("Error saving last external IP of '%s' to SKVS: %s", appName, err.Error())
+func (hpm *hostToProxyMap) appNames() []string {
+	hpm.mutex.RLock()
+	defer hpm.mutex.RUnlock()
+
+	names := make([]string, 0, len(hpm.apps))
+	for appName := range hpm.apps {
+		names = append(names, appName)
+	}
+	return names
+}
+
+// updateApp adds or rebuilds the entries of a single app, leaving all other apps untouched.
+// If the app can't be loaded it is marked unhealthy and keeps its previous entries, if any.
+func (hpm *hostToProxyMap) updateApp(appName string) error {
+	boxName, err := skvs.Get("ptw/node_name")
+	if err != nil {
+		hpm.markAppUnhealthy(appName, err)
+		return err
+	}
+
+	fmt.Printf("new Host=>IP mapping for app '%s':\n", appName)
+	route, err := buildAppRoutes(appName, boxName)
+	if err != nil {
+		log.Errorf("Failed to load app '%s': %s", appName, err.Error())
+		hpm.markAppUnhealthy(appName, err)
+		return err
+	}
+
+	hpm.mutex.Lock()
+	if hpm.actualMap == nil {
+		hpm.actualMap = make(map[string]http.Handler)
+		hpm.apps = make(map[string]*appRoute)
+	}
+
+	oldRoute, hadRoute := hpm.apps[appName]
+	if hadRoute {
+		for _, host := range oldRoute.hosts() {
+			delete(hpm.actualMap, host)
 		}
+	}
+	for _, host := range route.hosts() {
+		hpm.actualMap[host] = route
+	}
+	hpm.apps[appName] = route
+	// under the lock, so IP changes can't overtake the update
+	hpm.streams.update(appName, route.extIP, route.appIPs, route.streams)
+	hpm.mutex.Unlock()
 
-		newMap[extAppIP] = appProxy
-		fmt.Printf("  %s => %s\n", extAppIP, appIP)
+	// stopping waits for a running check, so don't block requests meanwhile
+	if hadRoute {
+		stopHealthCheck(oldRoute.proxy)
 	}
+	startHealthCheck(route.proxy, route.healthCheck)
 
-	hpm.stopAppExternalIPMonitoring()
+	return nil
+}
 
+func (hpm *hostToProxyMap) markAppUnhealthy(appName string, err error) {
 	hpm.mutex.Lock()
-	hpm.actualMap = newMap
+	defer hpm.mutex.Unlock()
+
+	if hpm.apps == nil {
+		hpm.actualMap = make(map[string]http.Handler)
+		hpm.apps = make(map[string]*appRoute)
+	}
+
+	route, ok := hpm.apps[appName]
+	if !ok {
+		route = &appRoute{}
+		hpm.apps[appName] = route
+	}
+	route.err = err
+}
+
+// removeApp deletes all entries of an app.
+func (hpm *hostToProxyMap) removeApp(appName string) {
+	hpm.mutex.Lock()
+	route, ok := hpm.apps[appName]
+	if !ok {
+		hpm.mutex.Unlock()
+		return
+	}
+
+	for _, host := range route.hosts() {
+		delete(hpm.actualMap, host)
+	}
+	delete(hpm.apps, appName)
+	hpm.streams.remove(appName)
 	hpm.mutex.Unlock()
 
-	hpm.startAppExternalIPMonitoring(apps)
+	stopHealthCheck(route.proxy)
+	log.Infof("Removed routes of app '%s'\n", appName)
+}
+
+// appStatus is the externally visible state of an app route.
+type appStatus struct {
+	Healthy bool     `json:"healthy"`
+	Error   string   `json:"error,omitempty"`
+	Hosts   []string `json:"hosts"`
+	// forwarded raw TCP and UDP ports, like 'tcp/10.0.0.5:22'
+	Streams []string `json:"streams,omitempty"`
+}
+
+// status reports the route state of every app.
+func (hpm *hostToProxyMap) status() map[string]appStatus {
+	hpm.mutex.RLock()
+	defer hpm.mutex.RUnlock()
+
+	result := make(map[string]appStatus)
+	for appName, route := range hpm.apps {
+		status := appStatus{Healthy: route.err == nil, Hosts: route.hosts(), Streams: hpm.streams.addrs(appName)}
+		if route.err != nil {
+			status.Error = route.err.Error()
+		}
+		result[appName] = status
+	}
+
+	return result
+}
+
+// normalizeHost strips the port and trailing dot from a Host header and lowercases it.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
 
-	return len(newMap), nil
+	return strings.TrimSuffix(strings.ToLower(host), ".")
 }
 
+// hostPatterns returns the map keys which may match a normalized host,
+// ordered by precedence: the exact host first, then wildcard entries
+// like "*.example.com" from the longest to the shortest suffix.
+func hostPatterns(host string) []string {
+	patterns := []string{host}
+	if net.ParseIP(host) != nil {
+		return patterns
+	}
+
+	for i := strings.Index(host, "."); i >= 0 && i < len(host)-1; {
+		patterns = append(patterns, "*"+host[i:])
+
+		next := strings.Index(host[i+1:], ".")
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+
+	return patterns
+}
+
+// matchHost finds the app proxy responsible for a Host header.
 func (hpm *hostToProxyMap) matchHost(host string) http.Handler {
 	hpm.mutex.RLock()
 	defer hpm.mutex.RUnlock()
 
-	if proxy, ok := hpm.actualMap[host]; ok {
-		return proxy
+	for _, pattern := range hostPatterns(normalizeHost(host)) {
+		if proxy, ok := hpm.actualMap[pattern]; ok {
+			return proxy
+		}
+	}
+
+	return nil
+}
+
+// passthroughTarget is where TLS connections of an app are passed through to.
+type passthroughTarget struct {
+	route         string
+	backends      []string
+	proxyProtocol int
+}
+
+// passthrough returns the target of the app a TLS connection is passed through
+// to, found by server name or external IP. Connections terminated by the
+// gateway get none.
+func (hpm *hostToProxyMap) passthrough(serverName string) *passthroughTarget {
+	hpm.mutex.RLock()
+	defer hpm.mutex.RUnlock()
+
+	for _, pattern := range hostPatterns(normalizeHost(serverName)) {
+		route, ok := hpm.actualMap[pattern].(*appRoute)
+		if !ok {
+			continue
+		}
+		if route.tlsPassthrough == 0 {
+			return nil
+		}
+
+		target := &passthroughTarget{route: appRouteName(route.name), proxyProtocol: route.tlsPassthroughProxyProtocol}
+		for _, ip := range route.appIPs {
+			target.backends = append(target.backends, net.JoinHostPort(ip, strconv.Itoa(route.tlsPassthrough)))
+		}
+		return target
+	}
+	return nil
+}
+
+// match finds the handler for a request. Hosts take precedence over paths:
+// for every host pattern the path routes are tried longest prefix first,
+// then the app proxy of that host. Path routes without host come last.
+func (hpm *hostToProxyMap) match(req *http.Request) http.Handler {
+	hpm.mutex.RLock()
+	defer hpm.mutex.RUnlock()
+
+	patterns := hostPatterns(normalizeHost(req.Host))
+	if patterns[0] != "" {
+		patterns = append(patterns, "")
+	}
+	for _, pattern := range patterns {
+		for _, route := range hpm.pathRoutes[pattern] {
+			if route.matchPath(req.URL.Path) {
+				return route
+			}
+		}
+
+		if pattern == "" {
+			continue
+		}
+
+		if proxy, ok := hpm.actualMap[pattern]; ok {
+			return proxy
+		}
 	}
 
 	return nil
@@ -209,10 +554,39 @@ func getRealDeviceIPs() ([]string, error) {
 	return addresses, nil
 }
 
-func getAppIP(appName string) (string, error) {
+// isAppContainer tells whether a container returned by the (substring) name filter
+// really belongs to an app: it carries the app label or is named like the app,
+// optionally with a scaling suffix such as "gitlab_2".
+func isAppContainer(appName string, container types.Container) bool {
+	if container.Labels[appLabel] == appName {
+		return true
+	}
+
+	for _, name := range container.Names {
+		name = strings.TrimPrefix(name, "/")
+		if name == appName {
+			return true
+		}
+
+		if !strings.HasPrefix(name, appName) {
+			continue
+		}
+		rest := name[len(appName):]
+		if len(rest) > 1 && (rest[0] == '_' || rest[0] == '-') {
+			if _, err := strconv.Atoi(rest[1:]); err == nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// getAppIP returns the protonet IPs of all containers of an app.
+func getAppIP(appName string) ([]string, error) {
 	cli, err := client.NewEnvClient()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	listOptions := types.ContainerListOptions{Filter: filters.NewArgs()}
@@ -220,23 +594,43 @@ func getAppIP(appName string) (string, error) {
 
 	containers, err := cli.ContainerList(context.Background(), listOptions)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if len(containers) == 0 {
-		return "", fmt.Errorf("Found no container named '%s'", appName)
+		return nil, fmt.Errorf("Found no container named '%s'", appName)
 	}
 
-	data, err := cli.ContainerInspect(context.Background(), containers[0].ID)
-	if err != nil {
-		return "", err
+	var appContainers []types.Container
+	for _, container := range containers {
+		if isAppContainer(appName, container) {
+			appContainers = append(appContainers, container)
+		}
+	}
+	if len(appContainers) == 0 {
+		appContainers = containers[:1]
 	}
 
-	protonetNetworkData, ok := data.NetworkSettings.Networks["protonet"]
-	if !ok {
-		return "", fmt.Errorf("The '%s' container doesn't belong to the network 'protonet'.", appName)
+	var ips []string
+	for _, container := range appContainers {
+		data, err := cli.ContainerInspect(context.Background(), container.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		protonetNetworkData, ok := data.NetworkSettings.Networks["protonet"]
+		if !ok {
+			log.Warningf("getAppIP(): container %s of '%s' doesn't belong to the network 'protonet'.", container.ID, appName)
+			continue
+		}
+
+		ips = append(ips, protonetNetworkData.IPAddress)
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("The '%s' container doesn't belong to the network 'protonet'.", appName)
 	}
 
-	return protonetNetworkData.IPAddress, nil
+	return ips, nil
 }
 
 func getExtInterfaceIP(interfaceName string) (string, error) {
@@ -77,12 +77,167 @@ func TestGetAppIP(t *testing.T) {
 	defer testserver.Close()
 	os.Setenv("DOCKER_HOST", testserver.URL)
 
-	ip, err := getAppIP("foobarapp")
+	ips, err := getAppIP("foobarapp")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if ip != testContainersDetails["8fb6d8595f23"].NetworkSettings.Networks["protonet"].IPAddress {
-		t.Fatalf("Expected ip %s, got %s", testContainersDetails["8fb6d8595f23"].NetworkSettings.Networks["protonet"].IPAddress, ip)
+	if len(ips) != 1 || ips[0] != testContainersDetails["8fb6d8595f23"].NetworkSettings.Networks["protonet"].IPAddress {
+		t.Fatalf("Expected ip %s, got %v", testContainersDetails["8fb6d8595f23"].NetworkSettings.Networks["protonet"].IPAddress, ips)
+	}
+}
+
+func TestAppNameFromIfName(t *testing.T) {
+	for _, appName := range []string{"gitlab", "app10", "a"} {
+		name, ok := appNameFromIfName(appIfName(appName))
+		if !ok || name != appName {
+			t.Fatalf("Expected app name %s, got %s (%v)", appName, name, ok)
+		}
+	}
+
+	for _, ifName := range []string{"eth0", "app_0", "app_gitlab", "docker0"} {
+		if name, ok := appNameFromIfName(ifName); ok {
+			t.Fatalf("Expected no app name for interface %s, got %s", ifName, name)
+		}
+	}
+}
+
+func TestHostToProxyMapAppState(t *testing.T) {
+	gitlabProxy := http.NotFoundHandler()
+	hpm := &hostToProxyMap{
+		actualMap: map[string]http.Handler{
+			"gitlab.box.protonet.info": gitlabProxy,
+			"192.168.0.10":             gitlabProxy,
+		},
+		apps: map[string]*appRoute{
+			"gitlab": {proxy: gitlabProxy, hostName: "gitlab.box.protonet.info", extIP: "192.168.0.10", wildcardHost: true},
+		},
+	}
+
+	hpm.markAppUnhealthy("gitlab", fmt.Errorf("container gone"))
+	hpm.markAppUnhealthy("owncloud", fmt.Errorf("Found no container named 'owncloud'"))
+
+	status := hpm.status()
+	if status["gitlab"].Healthy || len(status["gitlab"].Hosts) != 3 {
+		t.Fatalf("Expected unhealthy gitlab still routing, got %+v", status["gitlab"])
+	}
+	if status["owncloud"].Healthy || len(status["owncloud"].Hosts) != 0 {
+		t.Fatalf("Expected unhealthy owncloud without routes, got %+v", status["owncloud"])
+	}
+	if hpm.matchHost("gitlab.box.protonet.info") == nil {
+		t.Fatal("Expected unhealthy gitlab to keep its previous route")
+	}
+
+	hpm.removeApp("gitlab")
+	if hpm.matchHost("gitlab.box.protonet.info") != nil || hpm.matchHost("192.168.0.10") != nil {
+		t.Fatal("Expected all gitlab routes to be removed")
+	}
+	if _, ok := hpm.status()["gitlab"]; ok {
+		t.Fatal("Expected gitlab to be gone from the status")
+	}
+}
+
+func TestAppRouteHosts(t *testing.T) {
+	route := &appRoute{proxy: http.NotFoundHandler(), hostName: "GitLab.box.protonet.info", extIP: "192.168.0.10"}
+	if hosts := route.hosts(); len(hosts) != 2 || hosts[0] != "gitlab.box.protonet.info" || hosts[1] != "192.168.0.10" {
+		t.Fatalf("Expected hostname and external IP, got %v", hosts)
+	}
+
+	// subdomains only when asked for
+	route.wildcardHost = true
+	if hosts := route.hosts(); len(hosts) != 3 || hosts[1] != "*.gitlab.box.protonet.info" {
+		t.Fatalf("Expected the wildcard host too, got %v", hosts)
+	}
+}
+
+func TestAppHostNames(t *testing.T) {
+	proxy := http.NotFoundHandler()
+	hpm := &hostToProxyMap{
+		apps: map[string]*appRoute{
+			"gitlab":   {proxy: proxy, hostName: "GitLab.box.protonet.info"},
+			"mail":     {proxy: proxy, hostName: "mail.box.protonet.info", tlsPassthrough: 443},
+			"owncloud": {hostName: "owncloud.box.protonet.info"},
+		},
+	}
+
+	hostNames := hpm.appHostNames()
+	if len(hostNames) != 1 || hostNames["gitlab"] != "gitlab.box.protonet.info" {
+		t.Fatalf("Expected only gitlab's hostname, got %v", hostNames)
+	}
+}
+
+type testHandler struct {
+	name string
+}
+
+func (h *testHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Write([]byte(h.name))
+}
+
+func TestMatchHost(t *testing.T) {
+	exact := &testHandler{"exact"}
+	wildcard := &testHandler{"wildcard"}
+	longerWildcard := &testHandler{"longerWildcard"}
+	ipProxy := &testHandler{"ip"}
+
+	hpm := &hostToProxyMap{
+		actualMap: map[string]http.Handler{
+			"gitlab.box.protonet.info":      exact,
+			"*.gitlab.box.protonet.info":    wildcard,
+			"*.ci.gitlab.box.protonet.info": longerWildcard,
+			"192.168.0.10":                  ipProxy,
+			"2001:db8::1":                   ipProxy,
+			"*.box.protonet.info.example":   wildcard,
+		},
+	}
+
+	tests := []struct {
+		host     string
+		expected *testHandler
+	}{
+		{"gitlab.box.protonet.info", exact},
+		{"GitLab.Box.Protonet.Info", exact},
+		{"gitlab.box.protonet.info:443", exact},
+		{"gitlab.box.protonet.info.", exact},
+		{"www.gitlab.box.protonet.info", wildcard},
+		{"a.b.gitlab.box.protonet.info:80", wildcard},
+		{"ci.gitlab.box.protonet.info", wildcard},
+		{"runner.ci.gitlab.box.protonet.info", longerWildcard},
+		{"192.168.0.10:80", ipProxy},
+		{"[2001:db8::1]:443", ipProxy},
+		{"[2001:db8::1]", ipProxy},
+		{"box.protonet.info", nil},
+		{"agitlab.box.protonet.info", nil},
+		{"192.168.0.11", nil},
+		{"", nil},
+		{".", nil},
+	}
+
+	for _, test := range tests {
+		got := hpm.matchHost(test.host)
+		if test.expected == nil && got != nil || test.expected != nil && got != http.Handler(test.expected) {
+			t.Errorf("matchHost(%q): expected %v, got %v", test.host, test.expected, got)
+		}
+	}
+}
+
+func TestIsAppContainer(t *testing.T) {
+	tests := []struct {
+		container types.Container
+		expected  bool
+	}{
+		{types.Container{Names: []string{"/gitlab"}}, true},
+		{types.Container{Names: []string{"/gitlab_2"}}, true},
+		{types.Container{Names: []string{"/gitlab-3"}}, true},
+		{types.Container{Names: []string{"/web_1"}, Labels: map[string]string{appLabel: "gitlab"}}, true},
+		{types.Container{Names: []string{"/gitlab-runner"}}, false},
+		{types.Container{Names: []string{"/gitlab_"}}, false},
+		{types.Container{Names: []string{"/mygitlab"}}, false},
+	}
+
+	for _, test := range tests {
+		if got := isAppContainer("gitlab", test.container); got != test.expected {
+			t.Errorf("isAppContainer(%v): expected %v, got %v", test.container.Names, test.expected, got)
+		}
 	}
 }
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Strategy selects how requests are spread over the backends of a Proxy.
+type Strategy string
+
+const (
+	// RoundRobin sends requests to all backends in turn.
+	RoundRobin Strategy = "round-robin"
+	// LeastConnections sends requests to the backend with the fewest requests in flight.
+	LeastConnections Strategy = "least-connections"
+	// ConsistentHash pins each client IP to one backend.
+	ConsistentHash Strategy = "consistent-hash"
+)
+
+// number of points per backend on the consistent hash ring
+const hashRingReplicas = 100
+
+// ParseStrategy converts a strategy name, an empty name means RoundRobin.
+func ParseStrategy(name string) (Strategy, error) {
+	switch Strategy(name) {
+	case "":
+		return RoundRobin, nil
+	case RoundRobin, LeastConnections, ConsistentHash:
+		return Strategy(name), nil
+	}
+
+	return "", fmt.Errorf("unknown load balancing strategy '%s'", name)
+}
+
+// Backend is a single upstream server of a Proxy.
+type Backend struct {
+	active  int64 // first for 64-bit alignment of atomic access
+	down    int32
+	breaker breakerState
+	URL     *url.URL
+}
+
+// ActiveRequests returns the number of requests currently proxied to the backend.
+func (b *Backend) ActiveRequests() int64 {
+	return atomic.LoadInt64(&b.active)
+}
+
+type ringEntry struct {
+	hash    uint32
+	backend *Backend
+}
+
+type hashRing []ringEntry
+
+func (r hashRing) Len() int           { return len(r) }
+func (r hashRing) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r hashRing) Less(i, j int) bool { return r[i].hash < r[j].hash }
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+type pool struct {
+	counter  uint64 // first for 64-bit alignment of atomic access
+	strategy Strategy
+	backends []*Backend
+	ring     hashRing
+	mutex    sync.RWMutex
+}
+
+func newPool(strategy Strategy, urls []*url.URL) *pool {
+	p := &pool{strategy: strategy}
+	p.set(urls)
+	return p
+}
+
+// set replaces the backends, keeping the state of backends which stay.
+func (p *pool) set(urls []*url.URL) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	old := make(map[string]*Backend)
+	for _, backend := range p.backends {
+		old[backend.URL.String()] = backend
+	}
+
+	backends := make([]*Backend, 0, len(urls))
+	ring := make(hashRing, 0, len(urls)*hashRingReplicas)
+	for _, u := range urls {
+		backend, ok := old[u.String()]
+		if !ok {
+			backend = &Backend{URL: u}
+		}
+		backends = append(backends, backend)
+
+		for i := 0; i < hashRingReplicas; i++ {
+			ring = append(ring, ringEntry{hash: hashKey(u.String() + "#" + strconv.Itoa(i)), backend: backend})
+		}
+	}
+	sort.Sort(ring)
+
+	p.backends = backends
+	p.ring = ring
+}
+
+func (p *pool) list() []*Backend {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return append([]*Backend(nil), p.backends...)
+}
+
+// pick selects the backend for a request, skipping unhealthy backends,
+// backends with an open circuit and the excluded ones.
+// It returns nil if there is no backend left.
+func (p *pool) pick(req *http.Request, exclude map[*Backend]bool) *Backend {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if len(p.backends) == 0 {
+		return nil
+	}
+
+	usable := func(backend *Backend) bool {
+		return !exclude[backend] && backend.available()
+	}
+
+	switch p.strategy {
+	case LeastConnections:
+		var best *Backend
+		for _, backend := range p.backends {
+			if !usable(backend) {
+				continue
+			}
+			if best == nil || backend.ActiveRequests() < best.ActiveRequests() {
+				best = backend
+			}
+		}
+		return best
+	case ConsistentHash:
+		clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			clientIP = req.RemoteAddr
+		}
+		hash := hashKey(clientIP)
+		start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= hash })
+		// the clients of an ejected backend move on to the next one on the ring
+		for i := 0; i < len(p.ring); i++ {
+			backend := p.ring[(start+i)%len(p.ring)].backend
+			if usable(backend) {
+				return backend
+			}
+		}
+		return nil
+	default:
+		n := atomic.AddUint64(&p.counter, 1)
+		for i := uint64(0); i < uint64(len(p.backends)); i++ {
+			backend := p.backends[(n-1+i)%uint64(len(p.backends))]
+			if usable(backend) {
+				return backend
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testBackends(t *testing.T, rawURLs ...string) []*url.URL {
+	var urls []*url.URL
+	for _, rawURL := range rawURLs {
+		u, err := url.Parse(rawURL)
+		assert.Nil(t, err)
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+func TestParseStrategy(t *testing.T) {
+	for name, expected := range map[string]Strategy{
+		"":                  RoundRobin,
+		"round-robin":       RoundRobin,
+		"least-connections": LeastConnections,
+		"consistent-hash":   ConsistentHash,
+	} {
+		strategy, err := ParseStrategy(name)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, strategy)
+	}
+
+	_, err := ParseStrategy("random")
+	assert.NotNil(t, err)
+}
+
+func TestRoundRobin(t *testing.T) {
+	p := newPool(RoundRobin, testBackends(t, "http://10.0.0.1/", "http://10.0.0.2/", "http://10.0.0.3/"))
+	req := httptest.NewRequest("GET", "/", nil)
+
+	var hosts []string
+	for i := 0; i < 6; i++ {
+		hosts = append(hosts, p.pick(req, nil).URL.Host)
+	}
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1", "10.0.0.2", "10.0.0.3"}, hosts)
+}
+
+func TestLeastConnections(t *testing.T) {
+	p := newPool(LeastConnections, testBackends(t, "http://10.0.0.1/", "http://10.0.0.2/"))
+	req := httptest.NewRequest("GET", "/", nil)
+
+	backends := p.list()
+	backends[0].active = 3
+	backends[1].active = 1
+	assert.Equal(t, backends[1], p.pick(req, nil))
+
+	backends[1].active = 5
+	assert.Equal(t, backends[0], p.pick(req, nil))
+}
+
+func requestFrom(remoteAddr string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remoteAddr
+	return req
+}
+
+func TestConsistentHash(t *testing.T) {
+	p := newPool(ConsistentHash, testBackends(t, "http://10.0.0.1/", "http://10.0.0.2/", "http://10.0.0.3/"))
+
+	clients := make(map[string]*Backend)
+	for i := 0; i < 50; i++ {
+		clientIP := fmt.Sprintf("192.168.1.%d", i)
+		backend := p.pick(requestFrom(clientIP+":1234"), nil)
+		assert.Equal(t, backend, p.pick(requestFrom(clientIP+":4321"), nil), "same client IP must stick to the same backend")
+		clients[clientIP] = backend
+	}
+
+	used := make(map[*Backend]bool)
+	for _, backend := range clients {
+		used[backend] = true
+	}
+	assert.Len(t, used, 3, "clients should be spread over all backends")
+
+	// removing a backend only moves the clients of that backend
+	removed := p.list()[0]
+	p.set(testBackends(t, "http://10.0.0.2/", "http://10.0.0.3/"))
+	for clientIP, backend := range clients {
+		moved := p.pick(requestFrom(clientIP+":1234"), nil)
+		if backend == removed {
+			assert.NotEqual(t, removed, moved)
+		} else {
+			assert.Equal(t, backend, moved)
+		}
+	}
+}
+
+func TestPoolSetKeepsBackendState(t *testing.T) {
+	p := newPool(RoundRobin, testBackends(t, "http://10.0.0.1/", "http://10.0.0.2/"))
+	first := p.list()[0]
+	first.active = 2
+
+	p.set(testBackends(t, "http://10.0.0.1/", "http://10.0.0.3/"))
+	assert.Equal(t, first, p.list()[0])
+	assert.Equal(t, int64(2), p.list()[0].ActiveRequests())
+	assert.Equal(t, "10.0.0.3", p.list()[1].URL.Host)
+}
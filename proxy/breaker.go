@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CircuitBreaker configures passive outlier detection of a Proxy: a backend failing
+// FailureThreshold times in a row is skipped for OpenDuration. Afterwards it gets
+// requests again, but a single further failure opens the circuit right away.
+type CircuitBreaker struct {
+	// zero disables the circuit breaker
+	FailureThreshold int
+	OpenDuration     time.Duration
+}
+
+// backend answers counted as failure by the circuit breaker
+var failureStatusCodes = map[int]bool{
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+	mutex     sync.Mutex
+}
+
+// circuitOpen tells whether requests to the backend should currently fail fast.
+func (b *Backend) circuitOpen() bool {
+	b.breaker.mutex.Lock()
+	defer b.breaker.mutex.Unlock()
+
+	return time.Now().Before(b.breaker.openUntil)
+}
+
+// available tells whether the backend may receive requests.
+func (b *Backend) available() bool {
+	return b.Healthy() && !b.circuitOpen()
+}
+
+// reportResult feeds the outcome of a proxied request into the circuit breaker.
+func (b *Backend) reportResult(success bool, config CircuitBreaker) {
+	b.breaker.mutex.Lock()
+	defer b.breaker.mutex.Unlock()
+
+	if success {
+		if !b.breaker.openUntil.IsZero() {
+			log.Infof("Circuit to backend %s closed", b.URL.String())
+		}
+		b.breaker.failures = 0
+		b.breaker.openUntil = time.Time{}
+		return
+	}
+
+	b.breaker.failures++
+	if config.FailureThreshold > 0 && b.breaker.failures >= config.FailureThreshold {
+		log.Warningf("Circuit to backend %s opened after %d consecutive failures", b.URL.String(), b.breaker.failures)
+		b.breaker.openUntil = time.Now().Add(config.OpenDuration)
+	}
+}
+
+// isRetryable tells whether a request may be sent to another backend after
+// the first one failed. Only idempotent requests without body qualify.
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+	default:
+		return false
+	}
+
+	return req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 && len(req.TransferEncoding) == 0
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// deadBackend returns the URL of a port nobody listens on.
+func deadBackend(t *testing.T) *url.URL {
+	server := httptest.NewServer(http.NotFoundHandler())
+	u, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+	server.Close()
+	return u
+}
+
+func TestRetryIdempotentRequests(t *testing.T) {
+	alive := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("alive " + req.URL.Path))
+	}))
+	defer alive.Close()
+	aliveURL, _ := url.Parse(alive.URL)
+
+	p := NewBalanced(RoundRobin, deadBackend(t), aliveURL)
+	p.Retries = 1
+
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("GET", "/foo", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "alive /foo", rw.Body.String())
+
+	// requests with a body are never retried
+	p.backends.counter = 0
+	rw = httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("POST", "/foo", strings.NewReader("data")))
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, isRetryable(httptest.NewRequest("GET", "/", nil)))
+	assert.True(t, isRetryable(httptest.NewRequest("DELETE", "/", nil)))
+	assert.False(t, isRetryable(httptest.NewRequest("POST", "/", nil)))
+	assert.False(t, isRetryable(httptest.NewRequest("PUT", "/", strings.NewReader("data"))))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	dead := deadBackend(t)
+	p := New(dead)
+	p.CircuitBreaker = CircuitBreaker{FailureThreshold: 2, OpenDuration: 50 * time.Millisecond}
+	backend := p.Backends()[0]
+
+	for i := 0; i < 2; i++ {
+		assert.False(t, backend.circuitOpen())
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusBadGateway, rw.Code)
+	}
+	assert.True(t, backend.circuitOpen())
+	assert.Nil(t, p.backends.pick(httptest.NewRequest("GET", "/", nil), nil), "open circuit fails fast")
+
+	// half open: a single failure opens the circuit again
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, backend.circuitOpen())
+	backend.reportResult(false, p.CircuitBreaker)
+	assert.True(t, backend.circuitOpen())
+
+	// a success closes it
+	time.Sleep(60 * time.Millisecond)
+	backend.reportResult(true, p.CircuitBreaker)
+	backend.reportResult(false, p.CircuitBreaker)
+	assert.False(t, backend.circuitOpen())
+}
+
+func TestCircuitBreakerCountsGatewayErrors(t *testing.T) {
+	overloaded := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer overloaded.Close()
+	overloadedURL, _ := url.Parse(overloaded.URL)
+
+	p := New(overloadedURL)
+	p.CircuitBreaker = CircuitBreaker{FailureThreshold: 1, OpenDuration: time.Minute}
+
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code, "the backend answer is passed on")
+	assert.True(t, p.Backends()[0].circuitOpen())
+}
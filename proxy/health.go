@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"net/http"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// HealthCheck configures active health checking of the backends of a Proxy.
+type HealthCheck struct {
+	// Path requested on every backend, answers below 400 count as healthy
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// consecutive successful checks needed to bring a backend back
+	HealthyThreshold int
+	// consecutive failed checks needed to eject a backend
+	UnhealthyThreshold int
+}
+
+// BackendStatus is the externally visible state of a backend.
+type BackendStatus struct {
+	URL            string `json:"url"`
+	Healthy        bool   `json:"healthy"`
+	ActiveRequests int64  `json:"active_requests"`
+}
+
+// Healthy tells whether the backend receives requests.
+func (b *Backend) Healthy() bool {
+	return atomic.LoadInt32(&b.down) == 0
+}
+
+func (b *Backend) setHealthy(healthy bool) {
+	if healthy {
+		atomic.StoreInt32(&b.down, 0)
+	} else {
+		atomic.StoreInt32(&b.down, 1)
+	}
+}
+
+// Status returns the state of all backends of the proxy.
+func (p *Proxy) Status() []BackendStatus {
+	var result []BackendStatus
+	for _, backend := range p.backends.list() {
+		result = append(result, BackendStatus{
+			URL:            backend.URL.String(),
+			Healthy:        backend.Healthy(),
+			ActiveRequests: backend.ActiveRequests(),
+		})
+	}
+	return result
+}
+
+type healthChecker struct {
+	config HealthCheck
+	client *http.Client
+	// consecutive successes (positive) or failures (negative) per backend
+	streaks map[*Backend]int
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// StartHealthCheck checks all backends periodically and ejects the unhealthy ones
+// from load balancing until they recover. A running check is replaced.
+func (p *Proxy) StartHealthCheck(config HealthCheck) {
+	p.StopHealthCheck()
+
+	if config.Interval <= 0 {
+		config.Interval = 10 * time.Second
+	}
+	if config.Timeout <= 0 || config.Timeout > config.Interval {
+		config.Timeout = config.Interval
+	}
+	if config.HealthyThreshold <= 0 {
+		config.HealthyThreshold = 1
+	}
+	if config.UnhealthyThreshold <= 0 {
+		config.UnhealthyThreshold = 1
+	}
+
+	client := &http.Client{Timeout: config.Timeout}
+	if p.h2c {
+		// h2c backends may not speak HTTP/1.1
+		client.Transport = p.transport
+	}
+
+	checker := &healthChecker{
+		config:  config,
+		client:  client,
+		streaks: make(map[*Backend]int),
+		stop:    make(chan struct{}),
+	}
+
+	p.healthMutex.Lock()
+	p.healthChecker = checker
+	p.healthMutex.Unlock()
+
+	checker.wg.Add(1)
+	go checker.run(p.backends)
+}
+
+// StopHealthCheck stops active health checking, all backends stay in their last state.
+func (p *Proxy) StopHealthCheck() {
+	p.healthMutex.Lock()
+	checker := p.healthChecker
+	p.healthChecker = nil
+	p.healthMutex.Unlock()
+
+	if checker != nil {
+		close(checker.stop)
+		checker.wg.Wait()
+	}
+}
+
+func (c *healthChecker) run(backends *pool) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		c.checkAll(backends.list())
+
+		select {
+		case _ = <-c.stop:
+			return
+		case _ = <-ticker.C:
+		}
+	}
+}
+
+func (c *healthChecker) checkAll(backends []*Backend) {
+	results := make([]bool, len(backends))
+	var wg sync.WaitGroup
+	for i, backend := range backends {
+		wg.Add(1)
+		go func(i int, backend *Backend) {
+			defer wg.Done()
+			results[i] = c.check(backend)
+		}(i, backend)
+	}
+	wg.Wait()
+
+	streaks := make(map[*Backend]int)
+	for i, backend := range backends {
+		streak := c.streaks[backend]
+		if results[i] {
+			if streak < 0 {
+				streak = 0
+			}
+			streak++
+		} else {
+			if streak > 0 {
+				streak = 0
+			}
+			streak--
+		}
+		streaks[backend] = streak
+
+		if !backend.Healthy() && streak >= c.config.HealthyThreshold {
+			log.Infof("Backend %s is healthy again", backend.URL.String())
+			backend.setHealthy(true)
+		} else if backend.Healthy() && -streak >= c.config.UnhealthyThreshold {
+			log.Warningf("Backend %s is unhealthy, ejecting it", backend.URL.String())
+			backend.setHealthy(false)
+		}
+	}
+
+	// forget backends which left the pool
+	c.streaks = streaks
+}
+
+func (c *healthChecker) check(backend *Backend) bool {
+	checkURL := *backend.URL
+	checkURL.Path = path.Join("/", checkURL.Path, c.config.Path)
+
+	resp, err := c.client.Get(checkURL.String())
+	if err != nil {
+		log.Debugf("Health check of %s failed: %s", backend.URL.String(), err.Error())
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode < http.StatusBadRequest
+}
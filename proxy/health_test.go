@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheckEjectsAndRestoresBackends(t *testing.T) {
+	var failing int32 = 1
+	var checkedPath atomic.Value
+	flaky := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		checkedPath.Store(req.URL.Path)
+		if atomic.LoadInt32(&failing) == 1 {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer flaky.Close()
+	stable := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer stable.Close()
+
+	flakyURL, _ := url.Parse(flaky.URL + "/app/")
+	stableURL, _ := url.Parse(stable.URL)
+	p := NewBalanced(RoundRobin, flakyURL, stableURL)
+
+	checker := &healthChecker{
+		config:  HealthCheck{Path: "/health", HealthyThreshold: 2, UnhealthyThreshold: 2},
+		client:  &http.Client{Timeout: time.Second},
+		streaks: make(map[*Backend]int),
+	}
+	backends := p.Backends()
+
+	checker.checkAll(backends)
+	assert.Equal(t, "/app/health", checkedPath.Load())
+	assert.True(t, backends[0].Healthy(), "one failure is below the threshold")
+
+	checker.checkAll(backends)
+	assert.False(t, backends[0].Healthy())
+	assert.True(t, backends[1].Healthy())
+
+	req := httptest.NewRequest("GET", "/", nil)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, backends[1], p.backends.pick(req, nil))
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	checker.checkAll(backends)
+	assert.False(t, backends[0].Healthy(), "one success is below the threshold")
+	checker.checkAll(backends)
+	assert.True(t, backends[0].Healthy())
+
+	status := p.Status()
+	assert.Len(t, status, 2)
+	assert.True(t, status[0].Healthy)
+}
+
+func TestNoHealthyBackend(t *testing.T) {
+	backendURL, _ := url.Parse("http://10.0.0.1/")
+	p := NewBalanced(LeastConnections, backendURL)
+	p.Backends()[0].setHealthy(false)
+
+	assert.Nil(t, p.backends.pick(httptest.NewRequest("GET", "/", nil), nil))
+}
+
+func TestStartStopHealthCheck(t *testing.T) {
+	checks := make(chan struct{}, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		checks <- struct{}{}
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	p := New(backendURL)
+	p.StartHealthCheck(HealthCheck{Path: "/", Interval: 10 * time.Millisecond})
+
+	select {
+	case <-checks:
+	case <-time.After(time.Second):
+		t.Fatal("health check didn't run")
+	}
+
+	p.StopHealthCheck()
+	p.StopHealthCheck()
+}
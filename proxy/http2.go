@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// EnableH2C has the proxy talk HTTP/2 without TLS (h2c) to its http:// backends,
+// which have to support it. https:// backends keep negotiating the protocol by
+// ALPN. The response header timeout doesn't apply to h2c backends.
+func (p *Proxy) EnableH2C() {
+	p.h2c = true
+
+	timeouts := p.timeouts
+	if timeouts.Dial == 0 {
+		timeouts.Dial = defaultDialTimeout
+	}
+	if timeouts.Idle == 0 {
+		timeouts.Idle = defaultIdleTimeout
+	}
+	p.transport = newH2CTransport(timeouts, p.transport)
+}
+
+// h2cTransport sends requests to http:// backends by h2c, all others by its fallback.
+type h2cTransport struct {
+	h2c      *http2.Transport
+	fallback http.RoundTripper
+}
+
+func newH2CTransport(timeouts Timeouts, fallback http.RoundTripper) *h2cTransport {
+	if t, ok := fallback.(*h2cTransport); ok {
+		fallback = t.fallback
+	}
+
+	dialer := &net.Dialer{Timeout: timeouts.Dial, KeepAlive: 30 * time.Second}
+	return &h2cTransport{
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			// the connection is "upgraded" by speaking HTTP/2 right away
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+			IdleConnTimeout: timeouts.Idle,
+		},
+		fallback: fallback,
+	}
+}
+
+func (t *h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.fallback.RoundTrip(req)
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newGRPCBackend answers like a gRPC server would: HTTP/2 only, status in the trailers.
+func newGRPCBackend(t *testing.T) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, 2, req.ProtoMajor)
+		assert.Equal(t, "trailers", req.Header.Get("Te"))
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("message"))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	})
+	return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+}
+
+func TestH2CBackend(t *testing.T) {
+	backend := newGRPCBackend(t)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	p := New(backendURL)
+	p.SetTimeouts(Timeouts{ResponseHeader: time.Second})
+	p.EnableH2C()
+	frontend := httptest.NewUnstartedServer(p)
+	frontend.EnableHTTP2 = true
+	frontend.StartTLS()
+	defer frontend.Close()
+
+	req, _ := http.NewRequest("POST", frontend.URL+"/helloworld.Greeter/SayHello", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := frontend.Client().Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "message", string(body))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "ok", resp.Trailer.Get("Grpc-Message"))
+}
+
+type fakeTransport struct {
+	requests int
+}
+
+func (t *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests++
+	return nil, errors.New("fake")
+}
+
+func TestH2CTransportFallback(t *testing.T) {
+	fallback := &fakeTransport{}
+	transport := newH2CTransport(Timeouts{}, fallback)
+	// replacing the h2c transport keeps the original fallback
+	transport = newH2CTransport(Timeouts{}, transport)
+	assert.Equal(t, fallback, transport.fallback)
+
+	req, _ := http.NewRequest("GET", "https://127.0.0.1:1/", nil)
+	transport.RoundTrip(req)
+	assert.Equal(t, 1, fallback.requests)
+}
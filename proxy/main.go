@@ -1,13 +1,17 @@
 package proxy
 
 import (
-	"io"
+	"context"
+	"errors"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/koding/websocketproxy"
@@ -26,12 +30,27 @@ var hopHeaders = []string{
 	"Upgrade",
 }
 
+// ClientSubjectHeader carries the subject of the verified client certificate to the backend.
+const ClientSubjectHeader = "X-Client-Subject"
+
 // Proxy is the Central Gateway's customisable HTTP proxy backend
 type Proxy struct {
-	backend          *url.URL
+	// identifies the proxy in metrics
+	Name             string
+	backends         *pool
 	transport        http.RoundTripper
 	websocketProxy   http.Handler
 	WebsocketEnabled bool
+	// additional backends tried when an idempotent request can't be delivered
+	Retries        int
+	CircuitBreaker CircuitBreaker
+	// flush the response to the client periodically, negative means after every write
+	FlushInterval time.Duration
+	// set by SetTimeouts and EnableH2C
+	timeouts      Timeouts
+	h2c           bool
+	healthChecker *healthChecker
+	healthMutex   sync.Mutex
 }
 
 func isWebsocket(req *http.Request) bool {
@@ -44,14 +63,79 @@ func isWebsocket(req *http.Request) bool {
 
 // New creates a new Central Gateway proxy backend
 func New(backend *url.URL) *Proxy {
-	wsBackend := *backend
-	wsBackend.Scheme = "ws"
-	return &Proxy{
-		backend:          backend,
+	return NewBalanced(RoundRobin, backend)
+}
+
+// NewBalanced creates a new Central Gateway proxy spreading requests over several backends
+func NewBalanced(strategy Strategy, backends ...*url.URL) *Proxy {
+	p := &Proxy{
+		backends:         newPool(strategy, backends),
 		transport:        http.DefaultTransport,
-		websocketProxy:   websocketproxy.NewProxy(&wsBackend),
 		WebsocketEnabled: true,
 	}
+	p.websocketProxy = &websocketproxy.WebsocketProxy{
+		Backend: func(req *http.Request) *url.URL {
+			wsBackend := *backendFromContext(req)
+			wsBackend.Scheme = "ws"
+			wsBackend.Path = req.URL.Path
+			wsBackend.RawQuery = req.URL.RawQuery
+			return &wsBackend
+		},
+		// only a few headers are passed on by the websocket proxy itself
+		Director: func(req *http.Request, out http.Header) {
+			if subject := clientSubject(req); subject != "" {
+				out.Set(ClientSubjectHeader, subject)
+			}
+		},
+	}
+	return p
+}
+
+// SetBackends replaces the backends of the proxy,
+// backends staying in the pool keep their state.
+func (p *Proxy) SetBackends(backends ...*url.URL) {
+	p.backends.set(backends)
+}
+
+// Backends returns the current backends of the proxy.
+func (p *Proxy) Backends() []*Backend {
+	return p.backends.list()
+}
+
+type contextKey int
+
+const (
+	backendContextKey contextKey = iota
+	requestInfoContextKey
+)
+
+// RequestInfo is what the proxy reports about a request, e.g. for access logging.
+type RequestInfo struct {
+	// host of the last backend tried
+	Backend string
+	// why the request couldn't be proxied
+	Err error
+}
+
+// WithRequestInfo has the proxy fill in info while serving the request.
+func WithRequestInfo(req *http.Request, info *RequestInfo) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestInfoContextKey, info))
+}
+
+func requestInfoFromContext(req *http.Request) *RequestInfo {
+	if info, ok := req.Context().Value(requestInfoContextKey).(*RequestInfo); ok {
+		return info
+	}
+	return &RequestInfo{}
+}
+
+// withBackend passes the chosen backend on to the websocket proxy.
+func withBackend(req *http.Request, backend *url.URL) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), backendContextKey, backend))
+}
+
+func backendFromContext(req *http.Request) *url.URL {
+	return req.Context().Value(backendContextKey).(*url.URL)
 }
 
 /*func transformRequest(req *http.Request) {
@@ -59,6 +143,36 @@ func New(backend *url.URL) *Proxy {
 	newReq.U
 }*/
 
+// ForwardedProto returns the protocol the client used, "http" or "https".
+// An X-Forwarded-Proto header set by a proxy in front of the gateway is kept.
+func ForwardedProto(req *http.Request) string {
+	if protocol := req.Header.Get("X-Forwarded-Proto"); protocol != "" {
+		return protocol
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// clientSubject returns the subject of the client's certificate if that has been
+// verified, an empty string otherwise.
+func clientSubject(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return req.TLS.VerifiedChains[0][0].Subject.String()
+	}
+	return ""
+}
+
+// setClientSubject replaces whatever the client sent as its subject
+// by the subject of its certificate, if that has been verified.
+func setClientSubject(req *http.Request) {
+	req.Header.Del(ClientSubjectHeader)
+	if subject := clientSubject(req); subject != "" {
+		req.Header.Set(ClientSubjectHeader, subject)
+	}
+}
+
 func copyHeaders(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -68,20 +182,38 @@ func copyHeaders(dst, src http.Header) {
 }
 
 func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	info := requestInfoFromContext(req)
+
 	if p.WebsocketEnabled && isWebsocket(req) {
+		backend := p.backends.pick(req, nil)
+		if backend == nil {
+			info.Err = errors.New("no healthy backend available")
+			log.Errorf("proxying '%s': no healthy backend available\n", req.RequestURI)
+			gatewayErrors.WithLabelValues(p.Name, strconv.Itoa(http.StatusBadGateway)).Inc()
+			WriteErrorPage(rw, http.StatusBadGateway)
+			return
+		}
+		info.Backend = backend.URL.Host
+		atomic.AddInt64(&backend.active, 1)
+		defer atomic.AddInt64(&backend.active, -1)
+		websocketConnections.WithLabelValues(p.Name).Inc()
+		defer websocketConnections.WithLabelValues(p.Name).Dec()
+
 		// we don't use https explicitly, ssl termination is done here
 		req.URL.Scheme = "ws"
-		p.websocketProxy.ServeHTTP(rw, req)
+		p.websocketProxy.ServeHTTP(rw, withBackend(req, backend.URL))
 		return
 	}
 
-	req.URL.Scheme = p.backend.Scheme
-	req.URL.Host = p.backend.Host
-	req.URL.Path = path.Join(p.backend.Path, req.URL.Path)
+	requestPath := req.URL.Path
 
+	keepTrailers := wantsTrailers(req.Header)
 	for _, h := range hopHeaders {
 		req.Header.Del(h)
 	}
+	if keepTrailers {
+		req.Header.Set("Te", "trailers")
+	}
 
 	// TODO retain prior proxy info
 
@@ -94,30 +226,66 @@ func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	// Retain SSL information.
-	protocol := req.Header.Get("X-Forwarded-Proto")
-	if protocol == "" {
-		if req.TLS != nil {
-			req.Header.Set("X-Forwarded-Proto", "https")
-		} else {
-			req.Header.Set("X-Forwarded-Proto", "http")
-		}
+	req.Header.Set("X-Forwarded-Proto", ForwardedProto(req))
+	setClientSubject(req)
+
+	attempts := 1
+	if p.Retries > 0 && isRetryable(req) {
+		attempts += p.Retries
 	}
 
-	// the actual proxying is going on here!
-	resp, err := p.transport.RoundTrip(req)
+	var resp *http.Response
+	var err error
+	tried := make(map[*Backend]bool)
+	for attempt := 0; attempt < attempts; attempt++ {
+		backend := p.backends.pick(req, tried)
+		if backend == nil {
+			if err == nil {
+				err = errors.New("no healthy backend available")
+			}
+			break
+		}
+		tried[backend] = true
+		info.Backend = backend.URL.Host
+
+		req.URL.Scheme = backend.URL.Scheme
+		req.URL.Host = backend.URL.Host
+		req.URL.Path = path.Join(backend.URL.Path, requestPath)
+
+		// the actual proxying is going on here! The request carries the client's
+		// context, so the backend request is cancelled once the client disconnects.
+		atomic.AddInt64(&backend.active, 1)
+		resp, err = p.transport.RoundTrip(req)
+		atomic.AddInt64(&backend.active, -1)
+		p.countBackendRequest(backend, resp)
+
+		if err != nil && clientGone(req) {
+			// neither the backend's fault nor worth a retry
+			break
+		}
+		backend.reportResult(err == nil && !failureStatusCodes[resp.StatusCode], p.CircuitBreaker)
+		if err == nil {
+			break
+		}
+		log.Warningf("proxying '%s' to %s (attempt %d/%d): %s\n", req.RequestURI, backend.URL.Host, attempt+1, attempts, err.Error())
+	}
 
+	info.Err = err
+	if err != nil && clientGone(req) {
+		log.Debugf("proxying '%s': client disconnected\n", req.RequestURI)
+		return
+	}
 	if err != nil {
 		log.Errorf("proxying '%s': %s\n", req.RequestURI, err.Error())
-		rw.Header().Set("Content-Type", "text/html")
-		rw.WriteHeader(http.StatusBadGateway)
-		f, err := os.Open("/502.html")
-		if err != nil {
-			panic(err)
+		status := http.StatusBadGateway
+		if isTimeout(err) {
+			status = http.StatusGatewayTimeout
 		}
-		defer f.Close()
-		io.Copy(rw, f)
+		gatewayErrors.WithLabelValues(p.Name, strconv.Itoa(status)).Inc()
+		WriteErrorPage(rw, status)
 		return
 	}
+	defer resp.Body.Close()
 
 	for _, h := range hopHeaders {
 		resp.Header.Del(h)
@@ -125,6 +293,10 @@ func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// replace server software, so tcpdump on the external connection (and wget -S) makes more sense.
 	resp.Header.Set("Server", "central-gateway")
 	copyHeaders(rw.Header(), resp.Header)
+	announcedTrailers := announceTrailers(rw, resp)
 	rw.WriteHeader(resp.StatusCode)
-	io.Copy(rw, resp.Body)
+	if err := copyResponse(rw, resp.Body, p.flushIntervalFor(resp)); err != nil {
+		return
+	}
+	copyTrailers(rw, resp, announcedTrailers)
 }
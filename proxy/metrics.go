@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	backendRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "backend_requests_total",
+		Help:      "Requests sent to backends by route, backend and status code, \"error\" if no response arrived.",
+	}, []string{"route", "backend", "code"})
+
+	gatewayErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "proxy_errors_total",
+		Help:      "Requests the gateway answered itself with 502 or 504 because no backend responded.",
+	}, []string{"route", "code"})
+
+	websocketConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gateway",
+		Name:      "websocket_connections",
+		Help:      "Currently open websocket connections by route.",
+	}, []string{"route"})
+)
+
+func init() {
+	prometheus.MustRegister(backendRequests, gatewayErrors, websocketConnections)
+}
+
+// countBackendRequest records the outcome of a request to a backend,
+// resp is nil if the request failed.
+func (p *Proxy) countBackendRequest(backend *Backend, resp *http.Response) {
+	code := "error"
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	backendRequests.WithLabelValues(p.Name, backend.URL.Host, code).Inc()
+}
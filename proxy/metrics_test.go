@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyMetrics(t *testing.T) {
+	dead := deadBackend(t)
+	p := New(dead)
+	p.Name = "app:metrics-test"
+
+	// the counters are global, other tests may have counted already
+	errs := gatewayErrors.WithLabelValues("app:metrics-test", "502")
+	requests := backendRequests.WithLabelValues("app:metrics-test", dead.Host, "error")
+	errsBefore, requestsBefore := testutil.ToFloat64(errs), testutil.ToFloat64(requests)
+
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+
+	assert.Equal(t, errsBefore+1, testutil.ToFloat64(errs))
+	assert.Equal(t, requestsBefore+1, testutil.ToFloat64(requests))
+}
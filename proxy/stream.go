@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// flushIntervalFor returns how the body of a response is flushed to the client:
+// negative means after every write, zero never and positive periodically.
+// Event streams and bodies of unknown length are always flushed right away,
+// so server-sent events and long polling don't get stuck in buffers.
+func (p *Proxy) flushIntervalFor(resp *http.Response) time.Duration {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" || resp.ContentLength == -1 {
+		return -1
+	}
+
+	return p.FlushInterval
+}
+
+// wantsTrailers tells whether the client accepts trailers, which gRPC relies on.
+func wantsTrailers(header http.Header) bool {
+	for _, value := range header["Te"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// announceTrailers declares the trailers of a response before its header is written.
+func announceTrailers(rw http.ResponseWriter, resp *http.Response) int {
+	if len(resp.Trailer) == 0 {
+		return 0
+	}
+
+	keys := make([]string, 0, len(resp.Trailer))
+	for key := range resp.Trailer {
+		keys = append(keys, key)
+	}
+	rw.Header().Add("Trailer", strings.Join(keys, ", "))
+
+	return len(keys)
+}
+
+// copyTrailers sends the trailers of a response after its body was copied.
+// Trailers the backend didn't announce are sent with the http.TrailerPrefix.
+func copyTrailers(rw http.ResponseWriter, resp *http.Response, announced int) {
+	if len(resp.Trailer) == announced {
+		copyHeaders(rw.Header(), resp.Trailer)
+		return
+	}
+
+	for key, values := range resp.Trailer {
+		for _, value := range values {
+			rw.Header().Add(http.TrailerPrefix+key, value)
+		}
+	}
+}
+
+// flushWriter flushes the underlying ResponseWriter after every write or periodically.
+type flushWriter struct {
+	dst     io.Writer
+	flusher http.Flusher
+	latency time.Duration
+
+	mutex        sync.Mutex
+	flushPending bool
+	timer        *time.Timer
+	stopped      bool
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	n, err := w.dst.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	if w.latency < 0 {
+		w.flusher.Flush()
+		return n, nil
+	}
+
+	if !w.flushPending {
+		w.flushPending = true
+		w.timer = time.AfterFunc(w.latency, w.delayedFlush)
+	}
+
+	return n, nil
+}
+
+func (w *flushWriter) delayedFlush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// the handler might have returned already
+	if !w.flushPending || w.stopped {
+		return
+	}
+	w.flusher.Flush()
+	w.flushPending = false
+}
+
+func (w *flushWriter) stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// copyResponse streams a response body to the client, flushing as configured.
+func copyResponse(rw http.ResponseWriter, body io.Reader, flushInterval time.Duration) error {
+	var dst io.Writer = rw
+	if flusher, ok := rw.(http.Flusher); ok && flushInterval != 0 {
+		fw := &flushWriter{dst: rw, flusher: flusher, latency: flushInterval}
+		defer fw.stop()
+		dst = fw
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			log.Warningf("reading backend response: %s\n", readErr.Error())
+			return readErr
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestProxyServer(t *testing.T, backend *httptest.Server) *httptest.Server {
+	backendURL, err := url.Parse(backend.URL)
+	assert.Nil(t, err)
+	return httptest.NewServer(New(backendURL))
+}
+
+func TestStreamEventSource(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Write([]byte("data: first\n\n"))
+		rw.(http.Flusher).Flush()
+		<-release
+		rw.Write([]byte("data: second\n\n"))
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	gateway := newTestProxyServer(t, backend)
+	defer gateway.Close()
+
+	resp, err := http.Get(gateway.URL)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	lines := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		lines <- line
+	}()
+
+	select {
+	case line := <-lines:
+		assert.Equal(t, "data: first\n", line)
+	case <-time.After(2 * time.Second):
+		t.Fatal("first event wasn't flushed to the client")
+	}
+}
+
+func TestFlushIntervalFor(t *testing.T) {
+	p := New(&url.URL{Scheme: "http", Host: "10.0.0.1"})
+	p.FlushInterval = 100 * time.Millisecond
+
+	resp := &http.Response{Header: http.Header{"Content-Type": {"text/event-stream; charset=utf-8"}}, ContentLength: 100}
+	assert.Equal(t, time.Duration(-1), p.flushIntervalFor(resp))
+
+	resp = &http.Response{Header: http.Header{"Content-Type": {"text/html"}}, ContentLength: -1}
+	assert.Equal(t, time.Duration(-1), p.flushIntervalFor(resp))
+
+	resp = &http.Response{Header: http.Header{"Content-Type": {"text/html"}}, ContentLength: 100}
+	assert.Equal(t, 100*time.Millisecond, p.flushIntervalFor(resp))
+}
+
+func TestPeriodicFlush(t *testing.T) {
+	rw := httptest.NewRecorder()
+	fw := &flushWriter{dst: rw, flusher: rw, latency: 10 * time.Millisecond}
+	defer fw.stop()
+
+	fw.Write([]byte("data"))
+	fw.mutex.Lock()
+	assert.False(t, rw.Flushed)
+	fw.mutex.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	fw.mutex.Lock()
+	assert.True(t, rw.Flushed)
+	fw.mutex.Unlock()
+}
+
+func TestTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "trailers", req.Header.Get("Te"))
+		rw.Header().Set("Trailer", "Grpc-Status")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte("body"))
+		rw.Header().Set("Grpc-Status", "0")
+		// not announced
+		rw.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	}))
+	defer backend.Close()
+
+	gateway := newTestProxyServer(t, backend)
+	defer gateway.Close()
+
+	req, _ := http.NewRequest("GET", gateway.URL, nil)
+	req.Header.Set("Te", "trailers")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "body", string(body))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "ok", resp.Trailer.Get("Grpc-Message"))
+}
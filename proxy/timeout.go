@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+// Timeouts limit how long a Proxy waits for its backends, zero values keep the defaults.
+type Timeouts struct {
+	// establishing a connection to a backend
+	Dial time.Duration
+	// waiting for the response header once the request was sent
+	ResponseHeader time.Duration
+	// keeping an unused backend connection open
+	Idle time.Duration
+}
+
+// defaults of http.DefaultTransport
+const (
+	defaultDialTimeout = 30 * time.Second
+	defaultIdleTimeout = 90 * time.Second
+)
+
+// SetTimeouts gives the proxy its own transport using the timeouts.
+func (p *Proxy) SetTimeouts(timeouts Timeouts) {
+	if timeouts.Dial == 0 {
+		timeouts.Dial = defaultDialTimeout
+	}
+	if timeouts.Idle == 0 {
+		timeouts.Idle = defaultIdleTimeout
+	}
+
+	p.timeouts = timeouts
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   timeouts.Dial,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       timeouts.Idle,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+	}
+	// like http.DefaultTransport, HTTP/2 is spoken to backends offering it by ALPN
+	if err := http2.ConfigureTransport(transport); err != nil {
+		log.Errorf("configuring HTTP/2 to backends: %s\n", err.Error())
+	}
+	p.transport = transport
+	if p.h2c {
+		p.transport = newH2CTransport(p.timeouts, transport)
+	}
+}
+
+// isTimeout tells whether proxying failed because a backend took too long.
+func isTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// clientGone tells whether the client disconnected before the response was sent.
+func clientGone(req *http.Request) bool {
+	return req.Context().Err() == context.Canceled
+}
+
+// pages shown when a request can't be proxied or is refused,
+// the plain status text is sent if a page is missing
+var errorPages = map[int]string{
+	http.StatusForbidden:      "/403.html",
+	http.StatusBadGateway:     "/502.html",
+	http.StatusGatewayTimeout: "/504.html",
+}
+
+// WriteErrorPage answers a request with the error page for a status.
+func WriteErrorPage(rw http.ResponseWriter, status int) {
+	f, err := os.Open(errorPages[status])
+	if err != nil {
+		log.Errorf("opening error page: %s\n", err.Error())
+		http.Error(rw, http.StatusText(status), status)
+		return
+	}
+	defer f.Close()
+
+	rw.Header().Set("Content-Type", "text/html")
+	rw.WriteHeader(status)
+	io.Copy(rw, f)
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-req.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	slowURL, _ := url.Parse(slow.URL)
+
+	p := New(slowURL)
+	p.SetTimeouts(Timeouts{ResponseHeader: 50 * time.Millisecond})
+
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+
+	rw = httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+}
+
+func TestClientDisconnectCancelsBackendRequest(t *testing.T) {
+	cancelled := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+		close(cancelled)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	p := New(backendURL)
+	p.CircuitBreaker = CircuitBreaker{FailureThreshold: 1, OpenDuration: time.Minute}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, req)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("backend request wasn't cancelled")
+	}
+	// nothing is sent to a client that's gone and the backend isn't blamed
+	assert.Equal(t, 0, rw.Body.Len())
+	assert.False(t, p.Backends()[0].circuitOpen())
+}
+
+func TestIsTimeout(t *testing.T) {
+	assert.True(t, isTimeout(context.DeadlineExceeded))
+	assert.False(t, isTimeout(context.Canceled))
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/koding/websocketproxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebsocketClientSubject(t *testing.T) {
+	backend, _ := url.Parse("http://127.0.0.1:8080/")
+	director := New(backend).websocketProxy.(*websocketproxy.WebsocketProxy).Director
+
+	req := httptest.NewRequest("GET", "https://box.local/socket", nil)
+	req.Header.Set(ClientSubjectHeader, "CN=spoofed")
+	out := http.Header{}
+	director(req, out)
+	assert.Equal(t, "", out.Get(ClientSubjectHeader))
+
+	// the verified subject reaches websocket backends too
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "device-1"}}}}}
+	director(req, out)
+	assert.Equal(t, "CN=device-1", out.Get(ClientSubjectHeader))
+}
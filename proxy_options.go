@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/experimental-platform/platform-central-gateway/proxy"
+	skvs "github.com/experimental-platform/platform-skvs/client"
+)
+
+// proxyOptions are the proxy settings of a route. They are written inline in a route
+// of the route file or stored for an app as JSON in SKVS at 'apps/<name>/proxy', e.g.
+//
+//	{"balance": "least-connections", "retries": 1, "health_check": {"path": "/-/readiness"}}
+type proxyOptions struct {
+	Balance        string                `yaml:"balance" json:"balance,omitempty"`
+	HealthCheck    *healthCheckConfig    `yaml:"health_check" json:"health_check,omitempty"`
+	Retries        int                   `yaml:"retries" json:"retries,omitempty"`
+	CircuitBreaker *circuitBreakerConfig `yaml:"circuit_breaker" json:"circuit_breaker,omitempty"`
+	// periodic flushing of responses, "immediate" flushes after every write
+	FlushInterval string          `yaml:"flush_interval" json:"flush_interval,omitempty"`
+	Timeouts      *timeoutsConfig `yaml:"timeouts" json:"timeouts,omitempty"`
+	// talk HTTP/2 without TLS to http:// backends, e.g. gRPC servers
+	H2C bool `yaml:"h2c" json:"h2c,omitempty"`
+	// share of requests written to the access log, failed requests are always logged
+	AccessLogSample *float64 `yaml:"access_log_sample" json:"access_log_sample,omitempty"`
+	// redirect plain HTTP requests to HTTPS, except ACME challenges
+	RedirectHTTPS bool        `yaml:"redirect_https" json:"redirect_https,omitempty"`
+	HSTS          *hstsConfig `yaml:"hsts" json:"hsts,omitempty"`
+	// serve only clients with a certificate signed by the box CA
+	ClientCertificate bool `yaml:"client_certificate" json:"client_certificate,omitempty"`
+	// pass TLS connections undecrypted to this port of the app's containers
+	TLSPassthrough int `yaml:"tls_passthrough" json:"tls_passthrough,omitempty"`
+	// announce passed through clients by PROXY protocol, 'v1' or 'v2'
+	TLSPassthroughProxyProtocol string `yaml:"tls_passthrough_proxy_protocol" json:"tls_passthrough_proxy_protocol,omitempty"`
+	// route the subdomains of an app's hostname to the app as well
+	WildcardHost bool `yaml:"wildcard_host" json:"wildcard_host,omitempty"`
+}
+
+type healthCheckConfig struct {
+	Path               string `yaml:"path" json:"path"`
+	Interval           string `yaml:"interval" json:"interval,omitempty"`
+	Timeout            string `yaml:"timeout" json:"timeout,omitempty"`
+	HealthyThreshold   int    `yaml:"healthy_threshold" json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int    `yaml:"unhealthy_threshold" json:"unhealthy_threshold,omitempty"`
+}
+
+type timeoutsConfig struct {
+	Dial           string `yaml:"dial" json:"dial,omitempty"`
+	ResponseHeader string `yaml:"response_header" json:"response_header,omitempty"`
+	Idle           string `yaml:"idle" json:"idle,omitempty"`
+}
+
+type circuitBreakerConfig struct {
+	FailureThreshold int    `yaml:"failure_threshold" json:"failure_threshold"`
+	OpenDuration     string `yaml:"open_duration" json:"open_duration,omitempty"`
+}
+
+// proxySettings are validated proxyOptions.
+type proxySettings struct {
+	strategy       proxy.Strategy
+	healthCheck    *proxy.HealthCheck
+	retries        int
+	circuitBreaker proxy.CircuitBreaker
+	flushInterval  time.Duration
+	// nil keeps the default transport
+	timeouts        *proxy.Timeouts
+	h2c             bool
+	accessLogSample float64
+	tlsPolicy       tlsPolicy
+	// container port TLS connections are passed through to, zero terminates them
+	tlsPassthrough              int
+	tlsPassthroughProxyProtocol int
+	wildcardHost                bool
+}
+
+func defaultProxySettings() *proxySettings {
+	return &proxySettings{strategy: proxy.RoundRobin, accessLogSample: 1}
+}
+
+// parseOptionalDuration parses a duration, an empty value is zero.
+func parseOptionalDuration(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", name, err.Error())
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s can't be negative", name)
+	}
+	return d, nil
+}
+
+func (c *healthCheckConfig) build() (*proxy.HealthCheck, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(c.Path, "/") {
+		return nil, fmt.Errorf("health check path '%s' has to start with '/'", c.Path)
+	}
+	if c.HealthyThreshold < 0 || c.UnhealthyThreshold < 0 {
+		return nil, fmt.Errorf("health check thresholds can't be negative")
+	}
+
+	check := &proxy.HealthCheck{
+		Path:               c.Path,
+		HealthyThreshold:   c.HealthyThreshold,
+		UnhealthyThreshold: c.UnhealthyThreshold,
+	}
+
+	var err error
+	if check.Interval, err = parseOptionalDuration("health check interval", c.Interval); err != nil {
+		return nil, err
+	}
+	if check.Timeout, err = parseOptionalDuration("health check timeout", c.Timeout); err != nil {
+		return nil, err
+	}
+
+	return check, nil
+}
+
+func (c *circuitBreakerConfig) build() (proxy.CircuitBreaker, error) {
+	if c == nil {
+		return proxy.CircuitBreaker{}, nil
+	}
+
+	if c.FailureThreshold < 0 {
+		return proxy.CircuitBreaker{}, fmt.Errorf("circuit breaker failure threshold can't be negative")
+	}
+
+	openDuration, err := parseOptionalDuration("circuit breaker open duration", c.OpenDuration)
+	if err != nil {
+		return proxy.CircuitBreaker{}, err
+	}
+	if openDuration == 0 {
+		openDuration = 30 * time.Second
+	}
+
+	return proxy.CircuitBreaker{FailureThreshold: c.FailureThreshold, OpenDuration: openDuration}, nil
+}
+
+func (c *timeoutsConfig) build() (*proxy.Timeouts, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	timeouts := &proxy.Timeouts{}
+	var err error
+	if timeouts.Dial, err = parseOptionalDuration("dial timeout", c.Dial); err != nil {
+		return nil, err
+	}
+	if timeouts.ResponseHeader, err = parseOptionalDuration("response header timeout", c.ResponseHeader); err != nil {
+		return nil, err
+	}
+	if timeouts.Idle, err = parseOptionalDuration("idle timeout", c.Idle); err != nil {
+		return nil, err
+	}
+
+	return timeouts, nil
+}
+
+func (o proxyOptions) build() (*proxySettings, error) {
+	strategy, err := proxy.ParseStrategy(o.Balance)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Retries < 0 {
+		return nil, fmt.Errorf("retries can't be negative")
+	}
+
+	settings := defaultProxySettings()
+	settings.strategy = strategy
+	settings.retries = o.Retries
+	if settings.healthCheck, err = o.HealthCheck.build(); err != nil {
+		return nil, err
+	}
+	if settings.circuitBreaker, err = o.CircuitBreaker.build(); err != nil {
+		return nil, err
+	}
+	if o.FlushInterval == "immediate" {
+		settings.flushInterval = -1
+	} else if settings.flushInterval, err = parseOptionalDuration("flush interval", o.FlushInterval); err != nil {
+		return nil, err
+	}
+	if settings.timeouts, err = o.Timeouts.build(); err != nil {
+		return nil, err
+	}
+	settings.h2c = o.H2C
+	if o.AccessLogSample != nil {
+		if *o.AccessLogSample < 0 || *o.AccessLogSample > 1 {
+			return nil, fmt.Errorf("access log sample has to be between 0 and 1")
+		}
+		settings.accessLogSample = *o.AccessLogSample
+	}
+	settings.tlsPolicy.redirectHTTPS = o.RedirectHTTPS
+	settings.tlsPolicy.clientCert = o.ClientCertificate
+	if settings.tlsPolicy.hsts, err = o.HSTS.build(); err != nil {
+		return nil, err
+	}
+	if o.TLSPassthrough < 0 || o.TLSPassthrough > 65535 {
+		return nil, fmt.Errorf("invalid TLS passthrough port %d", o.TLSPassthrough)
+	}
+	settings.tlsPassthrough = o.TLSPassthrough
+	if settings.tlsPassthroughProxyProtocol, err = parseProxyProtocol(o.TLSPassthroughProxyProtocol); err != nil {
+		return nil, err
+	}
+	settings.wildcardHost = o.WildcardHost
+
+	return settings, nil
+}
+
+// newProxy creates a proxy to the backends configured by the settings, named
+// like its route. The health check isn't started, that's up to whoever installs the proxy.
+func (s *proxySettings) newProxy(name string, backends ...*url.URL) *proxy.Proxy {
+	p := proxy.NewBalanced(s.strategy, backends...)
+	p.Name = name
+	p.Retries = s.retries
+	p.CircuitBreaker = s.circuitBreaker
+	p.FlushInterval = s.flushInterval
+	if s.timeouts != nil {
+		p.SetTimeouts(*s.timeouts)
+	}
+	if s.h2c {
+		p.EnableH2C()
+	}
+	return p
+}
+
+// getAppProxySettings reads the proxy options of an app from SKVS,
+// apps without options get the defaults.
+func getAppProxySettings(appName string) (*proxySettings, error) {
+	var options proxyOptions
+	if data, err := skvs.Get(fmt.Sprintf("apps/%s/proxy", appName)); err == nil {
+		if err = json.Unmarshal([]byte(data), &options); err != nil {
+			return nil, fmt.Errorf("proxy options of app '%s': %s", appName, err.Error())
+		}
+	}
+
+	settings, err := options.build()
+	if err != nil {
+		return nil, fmt.Errorf("proxy options of app '%s': %s", appName, err.Error())
+	}
+	return settings, nil
+}
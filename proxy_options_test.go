@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/experimental-platform/platform-central-gateway/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheckConfig(t *testing.T) {
+	config := &healthCheckConfig{Path: "/ping", Interval: "5s", Timeout: "2s", UnhealthyThreshold: 3}
+	check, err := config.build()
+	assert.Nil(t, err)
+	assert.Equal(t, "/ping", check.Path)
+	assert.Equal(t, 5*time.Second, check.Interval)
+	assert.Equal(t, 2*time.Second, check.Timeout)
+	assert.Equal(t, 3, check.UnhealthyThreshold)
+
+	var noConfig *healthCheckConfig
+	check, err = noConfig.build()
+	assert.Nil(t, err)
+	assert.Nil(t, check)
+
+	for _, invalid := range []*healthCheckConfig{
+		{Path: "ping"},
+		{Path: "/ping", Interval: "often"},
+		{Path: "/ping", HealthyThreshold: -1},
+	} {
+		_, err = invalid.build()
+		assert.NotNil(t, err)
+	}
+}
+
+func TestProxyOptions(t *testing.T) {
+	settings, err := proxyOptions{}.build()
+	assert.Nil(t, err)
+	assert.Equal(t, proxy.RoundRobin, settings.strategy)
+	assert.Nil(t, settings.healthCheck)
+	assert.Equal(t, 0, settings.circuitBreaker.FailureThreshold)
+	assert.Equal(t, 1.0, settings.accessLogSample)
+
+	settings, err = proxyOptions{
+		Balance:        "consistent-hash",
+		Retries:        2,
+		CircuitBreaker: &circuitBreakerConfig{FailureThreshold: 3},
+	}.build()
+	assert.Nil(t, err)
+	assert.Equal(t, proxy.ConsistentHash, settings.strategy)
+	assert.Equal(t, 2, settings.retries)
+	assert.Equal(t, proxy.CircuitBreaker{FailureThreshold: 3, OpenDuration: 30 * time.Second}, settings.circuitBreaker)
+
+	tooOften := 1.5
+	for _, invalid := range []proxyOptions{
+		{Balance: "random"},
+		{Retries: -1},
+		{CircuitBreaker: &circuitBreakerConfig{FailureThreshold: -1}},
+		{CircuitBreaker: &circuitBreakerConfig{FailureThreshold: 1, OpenDuration: "-1s"}},
+		{AccessLogSample: &tooOften},
+		{TLSPassthrough: 70000},
+		{TLSPassthrough: 443, TLSPassthroughProxyProtocol: "v3"},
+	} {
+		_, err = invalid.build()
+		assert.NotNil(t, err)
+	}
+}
+
+func TestTimeoutsConfig(t *testing.T) {
+	config := &timeoutsConfig{Dial: "2s", ResponseHeader: "30s"}
+	timeouts, err := config.build()
+	assert.Nil(t, err)
+	assert.Equal(t, proxy.Timeouts{Dial: 2 * time.Second, ResponseHeader: 30 * time.Second}, *timeouts)
+
+	var noConfig *timeoutsConfig
+	timeouts, err = noConfig.build()
+	assert.Nil(t, err)
+	assert.Nil(t, timeouts)
+
+	_, err = (&timeoutsConfig{Idle: "forever"}).build()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout limits how long a trusted source may take to send its PROXY header.
+const proxyHeaderTimeout = 10 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+var errMissingProxyHeader = errors.New("missing PROXY protocol header")
+
+// parseTrustedProxies parses a comma separated list of IPs and CIDRs.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s'", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %s", entry, err.Error())
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// proxyProtoListener reads PROXY protocol v1 and v2 headers sent by trusted
+// sources and reports the addresses in them as the connection's addresses.
+// Trusted sources have to send the header, others can't send one.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func newProxyProtoListener(listener net.Listener, trusted []*net.IPNet) net.Listener {
+	if len(trusted) == 0 {
+		return listener
+	}
+	return &proxyProtoListener{Listener: listener, trusted: trusted}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return conn, nil
+	}
+	for _, ipNet := range l.trusted {
+		if ipNet.Contains(addr.IP) {
+			// read on first use, so a slow source doesn't hold up Accept
+			return &proxyProtoConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+		}
+	}
+	return conn, nil
+}
+
+type proxyProtoConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once     sync.Once
+	src, dst net.Addr
+	err      error
+
+	// set by the user of the connection, restored after reading the header
+	mutex    sync.Mutex
+	deadline time.Time
+}
+
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.src, c.dst, c.err = readProxyHeader(c.reader)
+		c.mutex.Lock()
+		c.Conn.SetReadDeadline(c.deadline)
+		c.mutex.Unlock()
+	})
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyProtoConn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.deadline = t
+	c.mutex.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtoConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.deadline = t
+	c.mutex.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyProtoConn) CloseWrite() error {
+	return closeWrapped(c.Conn)
+}
+
+// readProxyHeader consumes the PROXY protocol header a connection has to start
+// with. Headers without addresses, like v1 UNKNOWN or v2 LOCAL, return none.
+func readProxyHeader(reader *bufio.Reader) (src, dst net.Addr, err error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch first[0] {
+	case 'P':
+		if start, _ := reader.Peek(6); string(start) == "PROXY " {
+			return readProxyHeaderV1(reader)
+		}
+	case '\r':
+		if start, _ := reader.Peek(len(proxyV2Signature)); bytes.Equal(start, proxyV2Signature) {
+			return readProxyHeaderV2(reader)
+		}
+	}
+	return nil, nil, errMissingProxyHeader
+}
+
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	// the longest v1 header has 107 bytes
+	for len(line) < 107 && !bytes.HasSuffix(line, []byte("\r\n")) {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, nil, errInvalidProxyHeader
+	}
+	src, srcErr := parseProxyAddr(fields[2], fields[4])
+	dst, dstErr := parseProxyAddr(fields[3], fields[5])
+	if srcErr != nil || dstErr != nil {
+		return nil, nil, errInvalidProxyHeader
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil || p < 0 || p > 65535 {
+		return nil, errInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, errInvalidProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL connections, e.g. health checks of the proxy itself
+	if header[12]&0xf == 0 {
+		return nil, nil, nil
+	}
+	// only TCP is passed on, everything else keeps the real addresses
+	var size int
+	switch header[13] {
+	case 0x11:
+		size = net.IPv4len
+	case 0x21:
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, errInvalidProxyHeader
+	}
+	src := &net.TCPAddr{IP: net.IP(body[:size]), Port: int(binary.BigEndian.Uint16(body[2*size:]))}
+	dst := &net.TCPAddr{IP: net.IP(body[size : 2*size]), Port: int(binary.BigEndian.Uint16(body[2*size+2:]))}
+	return src, dst, nil
+}
+
+// parseProxyProtocol parses the PROXY protocol version sent to a backend,
+// 'v1' or 'v2'. An empty version sends none and is zero.
+func parseProxyProtocol(version string) (int, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "v1":
+		return 1, nil
+	case "v2":
+		return 2, nil
+	}
+	return 0, fmt.Errorf("unknown PROXY protocol version '%s'", version)
+}
+
+// writeProxyHeader announces a connection from src to dst to a backend.
+// Addresses other than TCP are sent as unknown.
+func writeProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	srcAddr, srcOK := src.(*net.TCPAddr)
+	dstAddr, dstOK := dst.(*net.TCPAddr)
+	known := srcOK && dstOK
+	ipv4 := known && srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil
+	if known && !ipv4 && (srcAddr.IP.To4() != nil) != (dstAddr.IP.To4() != nil) {
+		// both addresses have to be of the same family
+		known = false
+	}
+
+	var header []byte
+	if version == 1 {
+		if !known {
+			header = []byte("PROXY UNKNOWN\r\n")
+		} else {
+			family := "TCP6"
+			if ipv4 {
+				family = "TCP4"
+			}
+			header = []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+				family, srcAddr.IP.String(), dstAddr.IP.String(), srcAddr.Port, dstAddr.Port))
+		}
+	} else {
+		header = append([]byte{}, proxyV2Signature...)
+		switch {
+		case !known:
+			// LOCAL without addresses
+			header = append(header, 0x20, 0x00, 0, 0)
+		case ipv4:
+			header = append(header, 0x21, 0x11, 0, 12)
+			header = append(append(header, srcAddr.IP.To4()...), dstAddr.IP.To4()...)
+		default:
+			header = append(header, 0x21, 0x21, 0, 36)
+			header = append(append(header, srcAddr.IP.To16()...), dstAddr.IP.To16()...)
+		}
+		if known {
+			ports := make([]byte, 4)
+			binary.BigEndian.PutUint16(ports, uint16(srcAddr.Port))
+			binary.BigEndian.PutUint16(ports[2:], uint16(dstAddr.Port))
+			header = append(header, ports...)
+		}
+	}
+
+	_, err := w.Write(header)
+	return err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.1, 192.168.0.0/16,2001:db8::/32")
+	assert.Nil(t, err)
+	if assert.Len(t, trusted, 3) {
+		assert.True(t, trusted[0].Contains(net.ParseIP("10.0.0.1")))
+		assert.False(t, trusted[0].Contains(net.ParseIP("10.0.0.2")))
+		assert.True(t, trusted[1].Contains(net.ParseIP("192.168.1.1")))
+		assert.True(t, trusted[2].Contains(net.ParseIP("2001:db8::1")))
+	}
+
+	for _, invalid := range []string{"box.local", "10.0.0.0/33"} {
+		_, err := parseTrustedProxies(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		for _, addrs := range [][2]string{{"192.0.2.1:51000", "198.51.100.1:443"}, {"[2001:db8::1]:51000", "[2001:db8::2]:443"}} {
+			src, _ := net.ResolveTCPAddr("tcp", addrs[0])
+			dst, _ := net.ResolveTCPAddr("tcp", addrs[1])
+			var buf bytes.Buffer
+			assert.Nil(t, writeProxyHeader(&buf, version, src, dst))
+			buf.WriteString("payload")
+
+			reader := bufio.NewReader(&buf)
+			readSrc, readDst, err := readProxyHeader(reader)
+			assert.Nil(t, err)
+			if assert.NotNil(t, readSrc) && assert.NotNil(t, readDst) {
+				assert.Equal(t, addrs[0], readSrc.String())
+				assert.Equal(t, addrs[1], readDst.String())
+			}
+			rest, _ := ioutil.ReadAll(reader)
+			assert.Equal(t, "payload", string(rest))
+		}
+
+		// unknown addresses keep the connection's own
+		var buf bytes.Buffer
+		assert.Nil(t, writeProxyHeader(&buf, version, nil, nil))
+		buf.WriteString("payload")
+		reader := bufio.NewReader(&buf)
+		src, dst, err := readProxyHeader(reader)
+		assert.Nil(t, err)
+		assert.Nil(t, src)
+		assert.Nil(t, dst)
+		rest, _ := ioutil.ReadAll(reader)
+		assert.Equal(t, "payload", string(rest))
+	}
+
+	// the header isn't optional
+	for _, data := range []string{"GET / HTTP/1.1\r\n\r\n", "\x16\x03\x01", "PING\r\n"} {
+		_, _, err := readProxyHeader(bufio.NewReader(strings.NewReader(data)))
+		assert.Equal(t, errMissingProxyHeader, err, data)
+	}
+
+	for _, invalid := range []string{"PROXY TCP4 192.0.2.1\r\n", "PROXY TCP4 a b 1 2\r\n", "PROXY " + strings.Repeat("x", 200)} {
+		_, _, err := readProxyHeader(bufio.NewReader(strings.NewReader(invalid)))
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	for trusted, remote := range map[string]string{"127.0.0.0/8": "192.0.2.1:51000", "10.0.0.0/8": "127.0.0.1"} {
+		nets, _ := parseTrustedProxies(trusted)
+		raw, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		listener := newProxyProtoListener(raw, nets)
+
+		client, err := net.Dial("tcp", raw.Addr().String())
+		assert.Nil(t, err)
+		client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 51000 443\r\nping\n"))
+
+		conn, err := listener.Accept()
+		if assert.Nil(t, err) {
+			assert.True(t, strings.HasPrefix(conn.RemoteAddr().String(), remote), trusted)
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			if trusted == "127.0.0.0/8" {
+				assert.Equal(t, "ping\n", line)
+				assert.Equal(t, "198.51.100.1:443", conn.LocalAddr().String())
+			} else {
+				// untrusted sources can't claim other addresses
+				assert.True(t, strings.HasPrefix(line, "PROXY "))
+			}
+			conn.Close()
+		}
+		client.Close()
+		listener.Close()
+	}
+}
+
+func TestProxyProtoListenerRequiresHeader(t *testing.T) {
+	nets, _ := parseTrustedProxies("127.0.0.1")
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	listener := newProxyProtoListener(raw, nets)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", raw.Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+	client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	conn, err := listener.Accept()
+	if assert.Nil(t, err) {
+		_, err = conn.Read(make([]byte, 16))
+		assert.Equal(t, errMissingProxyHeader, err)
+		// the gateway's own address isn't reported as the client's
+		assert.Equal(t, client.LocalAddr().String(), conn.RemoteAddr().String())
+		conn.Close()
+	}
+}
+
+func TestForwardConnProxyProtocol(t *testing.T) {
+	// the backend trusts the gateway and sees the real client
+	nets, _ := parseTrustedProxies("127.0.0.1")
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	backend := newProxyProtoListener(raw, nets)
+	defer backend.Close()
+	remote := make(chan string, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		remote <- conn.RemoteAddr().String()
+		conn.Close()
+	}()
+
+	gateway, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer gateway.Close()
+	go func() {
+		conn, err := gateway.Accept()
+		if err != nil {
+			return
+		}
+		forwardConn(conn, "app:test", []string{raw.Addr().String()}, 0, 2, time.Minute)
+	}()
+
+	client, err := net.Dial("tcp", gateway.Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+	client.Write([]byte("ping"))
+
+	select {
+	case addr := <-remote:
+		assert.Equal(t, client.LocalAddr().String(), addr)
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend got no connection")
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/filters"
+	skvs "github.com/experimental-platform/platform-skvs/client"
+)
+
+// appLabel marks a Docker container as an app handled by the gateway.
+// The label value is the app name, if empty the container name is used.
+const appLabel = "protonet.app"
+
+type appEventType int
+
+const (
+	appAdded appEventType = iota
+	appRemoved
+)
+
+func (t appEventType) String() string {
+	if t == appAdded {
+		return "added"
+	}
+	return "removed"
+}
+
+type appEvent struct {
+	Type    appEventType
+	AppName string
+}
+
+// appSource returns the names of all apps known to a single backend.
+type appSource func() ([]string, error)
+
+// appRegistry keeps track of the apps installed on this box
+// and notifies subscribers whenever an app appears or disappears.
+type appRegistry struct {
+	sources     []appSource
+	sourceApps  [][]string
+	apps        map[string]bool
+	subscribers []chan appEvent
+	mutex       sync.RWMutex
+	// held while events are delivered, so they arrive in order
+	notifying sync.Mutex
+}
+
+func newAppRegistry(sources ...appSource) *appRegistry {
+	return &appRegistry{
+		sources:    sources,
+		sourceApps: make([][]string, len(sources)),
+		apps:       make(map[string]bool),
+	}
+}
+
+// list returns the sorted names of all currently known apps.
+func (r *appRegistry) list() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	result := make([]string, 0, len(r.apps))
+	for appName := range r.apps {
+		result = append(result, appName)
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+// subscribe returns a channel receiving all future add/remove events.
+func (r *appRegistry) subscribe() <-chan appEvent {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	ch := make(chan appEvent, 64)
+	r.subscribers = append(r.subscribers, ch)
+	return ch
+}
+
+// refresh queries all sources and returns the changes since the last call.
+// A failing source keeps its previously known apps, so a transient
+// error doesn't make apps vanish from the gateway. Events are never
+// dropped, refresh waits for slow subscribers.
+func (r *appRegistry) refresh() []appEvent {
+	r.mutex.Lock()
+
+	newApps := make(map[string]bool)
+	for i, source := range r.sources {
+		apps, err := source()
+		if err != nil {
+			log.Warningf("appRegistry.refresh(): app source failed, keeping last known state: %s", err.Error())
+			apps = r.sourceApps[i]
+		}
+		r.sourceApps[i] = apps
+
+		for _, appName := range apps {
+			newApps[appName] = true
+		}
+	}
+
+	var events []appEvent
+	for appName := range newApps {
+		if !r.apps[appName] {
+			events = append(events, appEvent{Type: appAdded, AppName: appName})
+		}
+	}
+	for appName := range r.apps {
+		if !newApps[appName] {
+			events = append(events, appEvent{Type: appRemoved, AppName: appName})
+		}
+	}
+	r.apps = newApps
+	subscribers := r.subscribers
+
+	// subscribers may call list meanwhile
+	r.notifying.Lock()
+	r.mutex.Unlock()
+	defer r.notifying.Unlock()
+
+	for _, event := range events {
+		log.Infof("App '%s' %s\n", event.AppName, event.Type)
+		for _, ch := range subscribers {
+			ch <- event
+		}
+	}
+
+	return events
+}
+
+// watch refreshes the registry every interval until stop is closed.
+func (r *appRegistry) watch(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case _ = <-stop:
+			return
+		case _ = <-ticker.C:
+			if events := r.refresh(); len(events) > 0 {
+				saveAppList(r.list())
+			}
+		}
+	}
+}
+
+// saveAppList publishes the app list in SKVS for other platform components.
+func saveAppList(apps []string) {
+	data, err := json.Marshal(&apps)
+	if err != nil {
+		log.Errorf("Error saving application list to SKVS: %s", err.Error())
+		return
+	}
+
+	err = skvs.Set("applist", string(data))
+	if err != nil {
+		log.Errorf("Error saving application list to SKVS: %s", err.Error())
+	}
+}
+
+// skvsNotFound tells a missing SKVS key from a failed read. The client has no
+// error for it, it reports the status of unsuccessful answers, which is 404 for
+// missing keys.
+func skvsNotFound(err error) bool {
+	if _, ok := err.(*url.Error); ok || err == nil {
+		// the request itself failed
+		return false
+	}
+	return skvsStatus(err) == http.StatusNotFound
+}
+
+// skvsStatus returns the HTTP status reported by a client error, zero if there
+// is none. Keys and URLs in the message aren't taken for it.
+func skvsStatus(err error) int {
+	for _, field := range strings.Fields(err.Error()) {
+		status, convErr := strconv.Atoi(strings.Trim(field, ":;,.()[]"))
+		if convErr == nil && status >= 100 && status < 600 {
+			return status
+		}
+	}
+	return 0
+}
+
+// skvsAppSource returns every app with an 'apps/<name>/enabled' key in SKVS.
+func skvsAppSource() ([]string, error) {
+	result := make([]string, 0)
+
+	// legacy location of the GitLab switch
+	if _, err := skvs.Get("gitlab/enabled"); err == nil {
+		result = append(result, "gitlab")
+	} else if !skvsNotFound(err) {
+		return nil, fmt.Errorf("skvsAppSource(): can't read 'gitlab/enabled': %s", err.Error())
+	}
+
+	data, err := skvs.Get("apps")
+	if skvsNotFound(err) {
+		// no app has ever been installed
+		return result, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("skvsAppSource(): can't read SKVS key list of 'apps': %s", err.Error())
+	}
+
+	var names []string
+	if err = json.Unmarshal([]byte(data), &names); err != nil {
+		return nil, fmt.Errorf("skvsAppSource(): can't parse SKVS key list of 'apps': %s", err.Error())
+	}
+
+	for _, appName := range names {
+		appName = strings.TrimSuffix(appName, "/")
+		if _, err := skvs.Get(fmt.Sprintf("apps/%s/enabled", appName)); err == nil {
+			result = append(result, appName)
+		} else if !skvsNotFound(err) {
+			return nil, fmt.Errorf("skvsAppSource(): can't read 'apps/%s/enabled': %s", appName, err.Error())
+		}
+	}
+
+	return result, nil
+}
+
+// dockerAppSource returns every container carrying the app label.
+func dockerAppSource() ([]string, error) {
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+
+	listOptions := types.ContainerListOptions{All: true, Filter: filters.NewArgs()}
+	listOptions.Filter.Add("label", appLabel)
+
+	containers, err := cli.ContainerList(context.Background(), listOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(containers))
+	for _, container := range containers {
+		appName := container.Labels[appLabel]
+		if appName == "" && len(container.Names) > 0 {
+			appName = strings.TrimPrefix(container.Names[0], "/")
+		}
+		if appName != "" {
+			result = append(result, appName)
+		}
+	}
+
+	return result, nil
+}
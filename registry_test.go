@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/experimental-platform/platform-skvs/client"
+	"github.com/experimental-platform/platform-skvs/server"
+)
+
+func TestAppRegistryRefresh(t *testing.T) {
+	skvsApps := []string{"gitlab"}
+	dockerApps := []string{"gitlab", "owncloud"}
+	var dockerErr error
+
+	r := newAppRegistry(
+		func() ([]string, error) { return skvsApps, nil },
+		func() ([]string, error) { return dockerApps, dockerErr },
+	)
+	events := r.subscribe()
+
+	assert.Len(t, r.refresh(), 2)
+	assert.Equal(t, []string{"gitlab", "owncloud"}, r.list())
+	assert.Len(t, events, 2)
+
+	// nothing changed
+	assert.Len(t, r.refresh(), 0)
+
+	// a failing source keeps its apps
+	dockerErr = fmt.Errorf("docker is down")
+	dockerApps = nil
+	assert.Len(t, r.refresh(), 0)
+	assert.Equal(t, []string{"gitlab", "owncloud"}, r.list())
+
+	dockerErr = nil
+	dockerApps = []string{"wordpress"}
+	changes := r.refresh()
+	assert.Len(t, changes, 2)
+	assert.Equal(t, []string{"gitlab", "wordpress"}, r.list())
+
+	for _, change := range changes {
+		switch change.AppName {
+		case "owncloud":
+			assert.Equal(t, appRemoved, change.Type)
+		case "wordpress":
+			assert.Equal(t, appAdded, change.Type)
+		default:
+			t.Fatalf("unexpected event %+v", change)
+		}
+	}
+}
+
+func TestAppRegistrySlowSubscriber(t *testing.T) {
+	var apps []string
+	for i := 0; i < 100; i++ {
+		apps = append(apps, fmt.Sprintf("app%d", i))
+	}
+	r := newAppRegistry(func() ([]string, error) { return apps, nil })
+	events := r.subscribe()
+
+	done := make(chan struct{})
+	go func() {
+		r.refresh()
+		close(done)
+	}()
+
+	// more events than the subscriber buffers are all delivered
+	received := make(map[string]bool)
+	for range apps {
+		event := <-events
+		assert.Equal(t, appAdded, event.Type)
+		received[event.AppName] = true
+		// subscribers can look at the registry while it delivers
+		r.list()
+	}
+	<-done
+	assert.Len(t, received, len(apps))
+}
+
+func TestSKVSNotFound(t *testing.T) {
+	testDataPath, err := ioutil.TempDir("", "")
+	assert.Nil(t, err)
+	skvsServer := httptest.NewServer(server.NewServerHandler(testDataPath, nil, nil))
+	c := client.NewFromURL(skvsServer.URL)
+	assert.Nil(t, c.Set("apps/gitlab/streams", "[]"))
+
+	_, err = c.Get("apps/gitlab/streams")
+	assert.False(t, skvsNotFound(err))
+	_, err = c.Get("apps/gitlab/proxy")
+	assert.True(t, skvsNotFound(err))
+
+	// neither are failures of keys looking like it
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "404 apps", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	_, err = client.NewFromURL(failing.URL).Get("apps/app404/streams")
+	assert.NotNil(t, err)
+	assert.False(t, skvsNotFound(err))
+
+	// unreachable isn't missing
+	skvsServer.Close()
+	_, err = c.Get("apps/gitlab/proxy")
+	assert.NotNil(t, err)
+	assert.False(t, skvsNotFound(err))
+}
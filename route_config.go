@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// routeConfig is a single static route as written in the route file.
+type routeConfig struct {
+	Host        string `yaml:"host" json:"host,omitempty"`
+	Path        string `yaml:"path" json:"path"`
+	Backend     string `yaml:"backend" json:"backend"`
+	StripPrefix bool   `yaml:"strip_prefix" json:"strip_prefix,omitempty"`
+
+	proxyOptions `yaml:",inline"`
+}
+
+// routeFile is the layout of the route file, JSON works as well since it's valid YAML.
+//
+//	routes:
+//	  - host: metrics.box.local
+//	    backend: http://127.0.0.1:3000
+//	  - path: /devices/
+//	    backend: http://127.0.0.1:9200
+//	    strip_prefix: true
+//	    retries: 1
+//	    circuit_breaker:
+//	      failure_threshold: 5
+//	      open_duration: 30s
+//	    health_check:
+//	      path: /ping
+//	      interval: 5s
+//	      unhealthy_threshold: 3
+//	connect:
+//	  - target: "*:22"
+//	    service: 127.0.0.1:22
+type routeFile struct {
+	Routes  []routeConfig       `yaml:"routes"`
+	Connect []connectRuleConfig `yaml:"connect"`
+
+	fileName string
+}
+
+func (c routeConfig) build() (*pathRoute, error) {
+	path := c.Path
+	if path == "" {
+		path = "/"
+	}
+
+	settings, err := c.proxyOptions.build()
+	if err != nil {
+		return nil, err
+	}
+	if settings.tlsPassthrough != 0 {
+		return nil, fmt.Errorf("TLS passthrough is only supported for apps")
+	}
+	if settings.wildcardHost {
+		return nil, fmt.Errorf("wildcard_host is only supported for apps, use a '*.' host instead")
+	}
+
+	return newPathRoute(c.Host, path, c.StripPrefix, c.Backend, settings)
+}
+
+func readRouteFile(fileName string) (*routeFile, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	file := routeFile{fileName: fileName}
+	if err = yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err.Error())
+	}
+	return &file, nil
+}
+
+// loadRouteFile parses and validates the routes of a route file.
+func loadRouteFile(fileName string) ([]*pathRoute, error) {
+	file, err := readRouteFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return file.pathRoutes()
+}
+
+// pathRoutes validates the routes of the file.
+func (f *routeFile) pathRoutes() ([]*pathRoute, error) {
+	routes := make([]*pathRoute, 0, len(f.Routes))
+	for i, config := range f.Routes {
+		route, err := config.build()
+		if err != nil {
+			return nil, fmt.Errorf("%s: route %d: %s", f.fileName, i+1, err.Error())
+		}
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+// connectRules validates the CONNECT rules of the file.
+func (f *routeFile) connectRules() ([]*connectRule, error) {
+	rules := make([]*connectRule, 0, len(f.Connect))
+	for i, config := range f.Connect {
+		rule, err := config.build()
+		if err != nil {
+			return nil, fmt.Errorf("%s: CONNECT rule %d: %s", f.fileName, i+1, err.Error())
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// mergeRoutes combines route lists, rejecting two routes for the same host and path.
+func mergeRoutes(lists ...[]*pathRoute) ([]*pathRoute, error) {
+	seen := make(map[string]bool)
+	var result []*pathRoute
+	for _, routes := range lists {
+		for _, route := range routes {
+			key := route.Host + route.PathPrefix
+			if seen[key] {
+				return nil, fmt.Errorf("duplicate route for '%s'", key)
+			}
+			seen[key] = true
+			result = append(result, route)
+		}
+	}
+
+	return result, nil
+}
+
+// staticRoutes holds the routes not derived from apps: the ones
+// given on the command line and the ones read from the route file.
+// The same goes for the CONNECT rules, if there is a policy to install them in.
+type staticRoutes struct {
+	fileName    string
+	flagRoutes  []*pathRoute
+	flagConnect []*connectRule
+	connect     *connectPolicy
+}
+
+// load reads the route file and installs all static routes in hpm.
+// On any error the currently installed routes are left untouched. Requests
+// in flight keep using the handler they were matched to, so nothing is dropped.
+func (s *staticRoutes) load(hpm *hostToProxyMap) error {
+	var fileRoutes []*pathRoute
+	var fileConnect []*connectRule
+	if s.fileName != "" {
+		// routes and rules from the same read, the file may change meanwhile
+		file, err := readRouteFile(s.fileName)
+		if err != nil {
+			return err
+		}
+		if fileRoutes, err = file.pathRoutes(); err != nil {
+			return err
+		}
+		if fileConnect, err = file.connectRules(); err != nil {
+			return err
+		}
+	}
+
+	routes, err := mergeRoutes(s.flagRoutes, fileRoutes)
+	if err != nil {
+		return err
+	}
+
+	hpm.setPathRoutes(routes)
+	log.Infof("%d static routes loaded\n", len(routes))
+	if s.connect != nil {
+		s.connect.setRules(append(append([]*connectRule{}, s.flagConnect...), fileConnect...))
+		log.Infof("%d CONNECT rules loaded\n", len(s.flagConnect)+len(fileConnect))
+	}
+	return nil
+}
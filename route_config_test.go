@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/experimental-platform/platform-central-gateway/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTempRouteFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "routes")
+	assert.Nil(t, err)
+	defer f.Close()
+
+	_, err = f.WriteString(content)
+	assert.Nil(t, err)
+	return f.Name()
+}
+
+func TestLoadRouteFile(t *testing.T) {
+	yamlFile := writeTempRouteFile(t, `
+routes:
+  - host: metrics.box.local
+    backend: http://127.0.0.1:3000
+  - path: /devices/
+    backend: http://127.0.0.1:9200
+    strip_prefix: true
+    retries: 2
+    circuit_breaker:
+      failure_threshold: 5
+`)
+	defer os.Remove(yamlFile)
+
+	routes, err := loadRouteFile(yamlFile)
+	assert.Nil(t, err)
+	assert.Len(t, routes, 2)
+	assert.Equal(t, "metrics.box.local", routes[0].Host)
+	assert.Equal(t, "/", routes[0].PathPrefix)
+	assert.Equal(t, "/devices/", routes[1].PathPrefix)
+	assert.True(t, routes[1].StripPrefix)
+	assert.Equal(t, 2, routes[1].handler.(*proxy.Proxy).Retries)
+	assert.Equal(t, 5, routes[1].handler.(*proxy.Proxy).CircuitBreaker.FailureThreshold)
+
+	jsonFile := writeTempRouteFile(t, `{"routes": [{"host": "metrics.box.local", "path": "/grafana", "backend": "http://127.0.0.1:3000", "retries": 1}]}`)
+	defer os.Remove(jsonFile)
+
+	routes, err = loadRouteFile(jsonFile)
+	assert.Nil(t, err)
+	assert.Len(t, routes, 1)
+	assert.Equal(t, "/grafana", routes[0].PathPrefix)
+	assert.Equal(t, 1, routes[0].handler.(*proxy.Proxy).Retries)
+
+	invalidFile := writeTempRouteFile(t, `
+routes:
+  - path: devices
+    backend: http://127.0.0.1:9200
+`)
+	defer os.Remove(invalidFile)
+
+	_, err = loadRouteFile(invalidFile)
+	assert.NotNil(t, err)
+
+	// misspelled options aren't silently ignored
+	for _, typo := range []string{"strip_prefx: true", "helth_check: {path: /ping}", "retries: often"} {
+		typoFile := writeTempRouteFile(t, `
+routes:
+  - path: /devices/
+    backend: http://127.0.0.1:9200
+    `+typo+`
+`)
+		_, err = loadRouteFile(typoFile)
+		os.Remove(typoFile)
+		assert.NotNil(t, err, typo)
+	}
+}
+
+func TestStaticRoutesLoadKeepsRoutesOnError(t *testing.T) {
+	routeFile := writeTempRouteFile(t, `
+routes:
+  - path: /status/
+    backend: http://127.0.0.1:3000
+`)
+	defer os.Remove(routeFile)
+
+	flagRoute, err := parseRouteSpec("/devices/=http://127.0.0.1:9200")
+	assert.Nil(t, err)
+
+	hpm := &hostToProxyMap{}
+	static := &staticRoutes{fileName: routeFile, flagRoutes: []*pathRoute{flagRoute}}
+	assert.Nil(t, static.load(hpm))
+	assert.Len(t, hpm.listPathRoutes(), 2)
+
+	// a duplicate of the command line route is rejected as a whole
+	err = ioutil.WriteFile(routeFile, []byte(`
+routes:
+  - path: /other/
+    backend: http://127.0.0.1:3000
+  - path: /devices/
+    backend: http://127.0.0.1:3001
+`), 0600)
+	assert.Nil(t, err)
+	assert.NotNil(t, static.load(hpm))
+
+	req := httptest.NewRequest("GET", "/status/", nil)
+	assert.NotNil(t, hpm.match(req))
+	req = httptest.NewRequest("GET", "/other/", nil)
+	assert.Nil(t, hpm.match(req))
+}
+
+func TestStaticRoutesLoadConnectRules(t *testing.T) {
+	routeFile := writeTempRouteFile(t, `
+connect:
+  - target: "ssh.box.local:22"
+    service: 127.0.0.1:2222
+    users: [admin]
+`)
+	defer os.Remove(routeFile)
+
+	flagRule, err := parseConnectSpec("*:22=127.0.0.1:22")
+	assert.Nil(t, err)
+	policy := &connectPolicy{}
+	static := &staticRoutes{fileName: routeFile, flagConnect: []*connectRule{flagRule}, connect: policy}
+	assert.Nil(t, static.load(&hostToProxyMap{}))
+	// the command line rules come first
+	assert.Equal(t, "127.0.0.1:22", policy.match("ssh.box.local:22").service)
+	assert.Len(t, policy.rules, 2)
+
+	err = ioutil.WriteFile(routeFile, []byte(`
+connect:
+  - target: "ssh.box.local"
+    service: 127.0.0.1:2222
+`), 0600)
+	assert.Nil(t, err)
+	assert.NotNil(t, static.load(&hostToProxyMap{}))
+	assert.Len(t, policy.rules, 2)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/experimental-platform/platform-central-gateway/proxy"
+)
+
+// pathRoute sends requests below a path prefix to a backend,
+// optionally restricted to a host or wildcard host pattern.
+type pathRoute struct {
+	Host        string `json:"host,omitempty"`
+	PathPrefix  string `json:"path"`
+	StripPrefix bool   `json:"strip_prefix,omitempty"`
+	Backend     string `json:"backend"`
+
+	handler         http.Handler
+	healthCheck     *proxy.HealthCheck
+	accessLogSample float64
+	tlsPolicy       tlsPolicy
+}
+
+// newPathRoute validates a route and creates the proxy to its backend,
+// nil settings mean the default proxy settings.
+func newPathRoute(host, pathPrefix string, stripPrefix bool, backend string, settings *proxySettings) (*pathRoute, error) {
+	if !strings.HasPrefix(pathPrefix, "/") {
+		return nil, fmt.Errorf("path prefix '%s' has to start with '/'", pathPrefix)
+	}
+
+	backendURL, err := url.Parse(backend)
+	if err != nil {
+		return nil, err
+	}
+	if backendURL.Scheme != "http" && backendURL.Scheme != "https" || backendURL.Host == "" {
+		return nil, fmt.Errorf("backend '%s' is not an absolute http(s) URL", backend)
+	}
+
+	if settings == nil {
+		settings = defaultProxySettings()
+	}
+
+	route := &pathRoute{
+		Host:            normalizeHost(host),
+		PathPrefix:      pathPrefix,
+		StripPrefix:     stripPrefix,
+		Backend:         backend,
+		healthCheck:     settings.healthCheck,
+		accessLogSample: settings.accessLogSample,
+		tlsPolicy:       settings.tlsPolicy,
+	}
+	route.handler = settings.newProxy(routeName(route), backendURL)
+	return route, nil
+}
+
+// parseRouteSpec parses a route given on the command line
+// as "[HOST]/PATH=BACKEND[;strip]", e.g. "box.local/devices/=http://127.0.0.1:9200;strip".
+func parseRouteSpec(spec string) (*pathRoute, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("route '%s' is missing a backend", spec)
+	}
+
+	slash := strings.Index(parts[0], "/")
+	if slash < 0 {
+		return nil, fmt.Errorf("route '%s' is missing a path", spec)
+	}
+
+	backend := parts[1]
+	stripPrefix := false
+	if strings.HasSuffix(backend, ";strip") {
+		backend = strings.TrimSuffix(backend, ";strip")
+		stripPrefix = true
+	}
+
+	return newPathRoute(parts[0][:slash], parts[0][slash:], stripPrefix, backend, nil)
+}
+
+// routeFlags collects repeated -route flags.
+type routeFlags []string
+
+func (f *routeFlags) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *routeFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func (r *pathRoute) matchPath(urlPath string) bool {
+	if !strings.HasPrefix(urlPath, r.PathPrefix) {
+		// "/devices" matches the prefix "/devices/"
+		return urlPath+"/" == r.PathPrefix
+	}
+
+	return strings.HasSuffix(r.PathPrefix, "/") || len(urlPath) == len(r.PathPrefix) || urlPath[len(r.PathPrefix)] == '/'
+}
+
+// name identifies the route in logs and the health report.
+func (r *pathRoute) name() string {
+	return r.Host + r.PathPrefix
+}
+
+func (r *pathRoute) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	labelAccessLog(req, routeName(r), r.accessLogSample)
+	if req = r.tlsPolicy.apply(w, req); req == nil {
+		return
+	}
+
+	if r.StripPrefix {
+		outReq := *req
+		outURL := *req.URL
+		outURL.Path = "/" + strings.TrimLeft(strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(r.PathPrefix, "/")), "/")
+		outURL.RawPath = ""
+		outReq.URL = &outURL
+		req = &outReq
+	}
+
+	r.handler.ServeHTTP(w, req)
+}
+
+// setPathRoutes replaces all path routes of the map.
+func (hpm *hostToProxyMap) setPathRoutes(routes []*pathRoute) {
+	byHost := make(map[string][]*pathRoute)
+	for _, route := range routes {
+		byHost[route.Host] = append(byHost[route.Host], route)
+	}
+
+	for _, hostRoutes := range byHost {
+		sort.Stable(byPrefixLength(hostRoutes))
+	}
+
+	hpm.mutex.Lock()
+	oldRoutes := hpm.pathRoutes
+	hpm.pathRoutes = byHost
+	hpm.mutex.Unlock()
+
+	for _, hostRoutes := range oldRoutes {
+		for _, route := range hostRoutes {
+			stopHealthCheck(route.handler)
+		}
+	}
+	for _, route := range routes {
+		startHealthCheck(route.handler, route.healthCheck)
+	}
+}
+
+// listPathRoutes returns all path routes ordered by host and precedence.
+func (hpm *hostToProxyMap) listPathRoutes() []*pathRoute {
+	hpm.mutex.RLock()
+	defer hpm.mutex.RUnlock()
+
+	hosts := make([]string, 0, len(hpm.pathRoutes))
+	for host := range hpm.pathRoutes {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	result := make([]*pathRoute, 0)
+	for _, host := range hosts {
+		result = append(result, hpm.pathRoutes[host]...)
+	}
+
+	return result
+}
+
+// byPrefixLength sorts routes longest path prefix first.
+type byPrefixLength []*pathRoute
+
+func (s byPrefixLength) Len() int           { return len(s) }
+func (s byPrefixLength) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byPrefixLength) Less(i, j int) bool { return len(s[i].PathPrefix) > len(s[j].PathPrefix) }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRouteSpec(t *testing.T) {
+	route, err := parseRouteSpec("Box.Local/devices/=http://127.0.0.1:9200;strip")
+	assert.Nil(t, err)
+	assert.Equal(t, "box.local", route.Host)
+	assert.Equal(t, "/devices/", route.PathPrefix)
+	assert.True(t, route.StripPrefix)
+	assert.Equal(t, "http://127.0.0.1:9200", route.Backend)
+
+	route, err = parseRouteSpec("/admin=http://127.0.0.1:8081/")
+	assert.Nil(t, err)
+	assert.Equal(t, "", route.Host)
+	assert.Equal(t, "/admin", route.PathPrefix)
+	assert.False(t, route.StripPrefix)
+
+	for _, spec := range []string{"box.local/devices/", "box.local=http://127.0.0.1", "/x=127.0.0.1:80", "/x=ftp://host/"} {
+		_, err = parseRouteSpec(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestPathRouteMatchPath(t *testing.T) {
+	withSlash := &pathRoute{PathPrefix: "/devices/"}
+	assert.True(t, withSlash.matchPath("/devices/"))
+	assert.True(t, withSlash.matchPath("/devices/foo"))
+	assert.True(t, withSlash.matchPath("/devices"))
+	assert.False(t, withSlash.matchPath("/devicesfoo"))
+
+	withoutSlash := &pathRoute{PathPrefix: "/admin"}
+	assert.True(t, withoutSlash.matchPath("/admin"))
+	assert.True(t, withoutSlash.matchPath("/admin/users"))
+	assert.False(t, withoutSlash.matchPath("/administrator"))
+}
+
+func TestPathRouteStripPrefix(t *testing.T) {
+	var seenPath string
+	backend := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		seenPath = req.URL.Path
+	})
+
+	route := &pathRoute{PathPrefix: "/devices/", StripPrefix: true, handler: backend}
+	for requestPath, expected := range map[string]string{
+		"/devices/":        "/",
+		"/devices":         "/",
+		"/devices/foo/bar": "/foo/bar",
+	} {
+		req := httptest.NewRequest("GET", requestPath, nil)
+		route.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, expected, seenPath, requestPath)
+		assert.Equal(t, requestPath, req.URL.Path, "original request must not be modified")
+	}
+}
+
+func TestMatchPathRoutes(t *testing.T) {
+	app := &testHandler{"app"}
+	hpm := &hostToProxyMap{
+		actualMap: map[string]http.Handler{
+			"gitlab.box.protonet.info":   app,
+			"*.gitlab.box.protonet.info": app,
+		},
+	}
+
+	devices := &pathRoute{Host: "box.local", PathPrefix: "/devices/", handler: &testHandler{"devices"}}
+	devicesAPI := &pathRoute{Host: "box.local", PathPrefix: "/devices/api/", handler: &testHandler{"devicesAPI"}}
+	gitlabMetrics := &pathRoute{Host: "gitlab.box.protonet.info", PathPrefix: "/-/metrics", handler: &testHandler{"metrics"}}
+	anyHost := &pathRoute{PathPrefix: "/status/", handler: &testHandler{"status"}}
+	hpm.setPathRoutes([]*pathRoute{devices, anyHost, devicesAPI, gitlabMetrics})
+
+	tests := []struct {
+		host, path string
+		expected   http.Handler
+	}{
+		{"box.local", "/devices/1", devices},
+		{"BOX.local:80", "/devices/api/v1", devicesAPI},
+		{"box.local", "/status/", anyHost},
+		{"box.local", "/", nil},
+		{"gitlab.box.protonet.info", "/-/metrics", gitlabMetrics},
+		{"gitlab.box.protonet.info", "/status/", app},
+		{"www.gitlab.box.protonet.info", "/-/metrics", app},
+		{"other.host", "/status/x", anyHost},
+		{"other.host", "/devices/", nil},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		req.Host = test.host
+		assert.Equal(t, test.expected, hpm.match(req), test.host+test.path)
+	}
+
+	assert.Equal(t, []*pathRoute{anyHost, devicesAPI, devices, gitlabMetrics}, hpm.listPathRoutes())
+}
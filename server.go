@@ -1,218 +1,325 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
-	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/experimental-platform/platform-central-gateway/proxy"
-	skvs "github.com/experimental-platform/platform-skvs/client"
 
 	"github.com/elazarl/goproxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
 )
 
-const enableDokkuGateway bool = false
-
 var DEBUG = false
-var if_bind *string
-var apps_target *string
-var management_target *string
-var apps_proxy http.Handler
-var management_proxy *httputil.ReverseProxy
-var devices_proxy *httputil.ReverseProxy
-var soulNginxProxy http.Handler
+var soulNginxProxy *switchingHandler
 
 var gatewayAppMap *hostToProxyMap
-
-var ADMIN_NAME = "admin"
-var ADMIN_PATH = "/" + ADMIN_NAME
-var ADMIN_FULL_PATH = ADMIN_PATH + "/"
-var DEVICES_PATH = "/devices/"
+var gatewayAppRegistry *appRegistry
+var gatewayCerts *certStore
 
 func defaultHandler(w http.ResponseWriter, req *http.Request) {
 	if DEBUG {
 		fmt.Printf("[%v] %+v\n", time.Now(), req)
 	}
 
-	if enableDokkuGateway {
-		urlPath := req.URL.Path
-		if urlPath == "/" || urlPath == "" || urlPath == ADMIN_PATH {
-			http.Redirect(w, req, ADMIN_FULL_PATH, http.StatusMovedPermanently)
-		} else if strings.HasPrefix(req.URL.String(), ADMIN_FULL_PATH) {
-			management_proxy.ServeHTTP(w, req)
-		} else if strings.HasPrefix(req.URL.String(), DEVICES_PATH) {
-			devices_proxy.ServeHTTP(w, req)
-		} else {
-			apps_proxy.ServeHTTP(w, req)
-		}
-	} else {
-		if appProxy := gatewayAppMap.matchHost(req.Host); appProxy != nil {
-			appProxy.ServeHTTP(w, req)
-			return
-		}
-
+	handler := gatewayAppMap.match(req)
+	if handler == nil {
 		// default backend
-		soulNginxProxy.ServeHTTP(w, req)
+		labelAccessLog(req, soulNginxContainer, 1)
+		handler = soulNginxProxy
 	}
+
+	serveInstrumented(handler, w, req)
 }
 
-func createProxy() *goproxy.ProxyHttpServer {
+func createProxy(connect *connectPolicy) http.Handler {
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.Verbose = true
 	proxy.NonproxyHandler = http.HandlerFunc(defaultHandler)
 
-	connectCondition := goproxy.ReqConditionFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) bool {
-		return r.Method == "CONNECT"
-	})
-
-	proxy.OnRequest(connectCondition).HijackConnect(func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
-		sshConn, err := net.Dial("tcp", "127.0.0.1:22")
-		if err != nil {
-			client.Write([]byte("HTTP/1.1 500 Failed to connect to SSH\r\n\r\n"))
-			//http.Error(client, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		var wg sync.WaitGroup
-		wg.Add(2)
-
-		go func() {
-			io.Copy(client, sshConn)
-			wg.Done()
-		}()
-		go func() {
-			io.Copy(sshConn, client)
-			wg.Done()
-		}()
-		wg.Wait()
-	})
-
-	return proxy
+	return connect.wrap(proxy)
 }
 
-func getSSLCert(c *skvs.Client) (string, string, error) {
-	if c == nil {
-		var err error
-		c, err = skvs.NewFromDocker()
-		if err != nil {
-			return "", "", fmt.Errorf("getSSLCert: %s", err.Error())
-		}
-	}
+// serverTimeouts limit slow clients on all listeners. Reading and writing whole
+// requests and responses isn't limited by default, that would break streaming.
+var serverTimeouts struct {
+	readHeader, read, write, idle time.Duration
+}
 
-	pemData, pemErr := c.Get("ssl/pem")
-	keyData, keyErr := c.Get("ssl/key")
-	if keyErr != nil || pemErr != nil {
-		fmt.Println("Failed to load certificate from SKVS - defaulting to pre-generated self-signed.")
-		return "/data/ssl/pem", "/data/ssl/key", nil
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: serverTimeouts.readHeader,
+		ReadTimeout:       serverTimeouts.read,
+		WriteTimeout:      serverTimeouts.write,
+		IdleTimeout:       serverTimeouts.idle,
 	}
+}
 
-	err := ioutil.WriteFile("/tmp/gateway_pem", []byte(pemData), 0644)
-	if err != nil {
-		return "", "", fmt.Errorf("getSSLCert: %s", err.Error())
-	}
-	err = ioutil.WriteFile("/tmp/gateway_key", []byte(keyData), 0644)
-	if err != nil {
-		return "", "", fmt.Errorf("getSSLCert: %s", err.Error())
+// configureHTTP2 offers HTTP/2 to the clients of a TLS server by ALPN,
+// falling back to HTTP/1.1. Disabled, only HTTP/1.1 is offered.
+func configureHTTP2(server *http.Server, enabled bool) error {
+	if !enabled {
+		server.TLSConfig.NextProtos = []string{"http/1.1"}
+		// a non-nil map keeps net/http from enabling HTTP/2 by itself
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		return nil
 	}
 
-	fmt.Println("Loaded TLS certificate from SKVS")
-	return "/tmp/gateway_pem", "/tmp/gateway_key", nil
+	server.TLSConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	return http2.ConfigureServer(server, nil)
 }
 
 func main() {
-	var err error
-	if_bind = flag.String("interface", "127.0.0.1:3001", "server interface to bind")
-	apps_target = flag.String("apps", "http://127.0.0.1:8080", "target URL for apps reverse proxy")
-	management_target = flag.String("management", "http://127.0.0.1:8081", "target URL for management reverse proxy")
+	var routeSpecs routeFlags
+	var connectSpecs routeFlags
+	httpListen := flag.String("http-listen", ":80", "addresses for plain HTTP, comma separated: 'HOST:PORT', 'unix:PATH' or 'systemd:NAME' for a socket passed by systemd")
+	httpsListen := flag.String("https-listen", ":443", "addresses for HTTPS, see -http-listen")
+	controlListen := flag.String("control-listen", "127.0.0.1:81", "addresses of the control API, see -http-listen")
+	legacyInterface := flag.String("interface", "", "deprecated, same as -http-listen")
+	// only used by the Dokku gateway, which is gone
+	legacyApps := flag.String("apps", "", "deprecated and ignored, use -route")
+	legacyManagement := flag.String("management", "", "deprecated and ignored, use -route")
+	connectIdleTimeout := flag.Duration("connect-idle-timeout", time.Hour, "time CONNECT tunnels may stay idle, 0 disables it")
+	streamIdleTimeout := flag.Duration("stream-idle-timeout", time.Hour, "time TCP connections to app stream ports and passed through TLS connections may stay idle, 0 disables it")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time in-flight requests and websockets get to finish on SIGTERM")
+	flag.Var(&routeSpecs, "route", "additional path route '[HOST]/PATH=BACKEND[;strip]', may be repeated")
+	flag.Var(&connectSpecs, "connect", "allowed CONNECT tunnel 'TARGET=SERVICE', may be repeated, 'off' for none (default \"*:22=127.0.0.1:22\" for SSH)")
+	routesFile := flag.String("routes-file", "", "YAML or JSON file with static routes, reloaded on SIGHUP")
+	acmeDirectory := flag.String("acme-directory", "", "ACME directory URL to obtain certificates of the app hostnames from, e.g. https://acme-v02.api.letsencrypt.org/directory")
+	acmeEmail := flag.String("acme-email", "", "contact address of the ACME account")
+	acmeCA := flag.String("acme-ca", "", "PEM file with additional CAs trusted for the ACME directory")
+	acmeChallenges := flag.String("acme-challenges", "http-01,tls-alpn-01", "ACME challenges to use, in order of preference")
+	flag.DurationVar(&serverTimeouts.readHeader, "read-header-timeout", 10*time.Second, "time allowed to read request headers")
+	flag.DurationVar(&serverTimeouts.read, "read-timeout", 0, "time allowed to read a whole request, 0 disables it")
+	flag.DurationVar(&serverTimeouts.write, "write-timeout", 0, "time allowed to write a whole response, 0 disables it")
+	flag.DurationVar(&serverTimeouts.idle, "idle-timeout", 2*time.Minute, "time keep-alive connections may stay idle")
+	accessLogTarget := flag.String("access-log", "stdout", "access log destination: 'stdout', a file reopened on SIGHUP, or 'off'")
+	accessLogFormat := flag.String("access-log-format", "combined", "access log format: 'combined' or 'json'")
+	enableHTTP2 := flag.Bool("http2", true, "offer HTTP/2 on the TLS listener")
+	proxyProtocolFrom := flag.String("proxy-protocol-from", "", "comma separated IPs and CIDRs whose PROXY protocol headers are accepted on the HTTP, HTTPS and stream listeners")
+	enableTLSPassthrough := flag.Bool("tls-passthrough", false, "pass TLS connections of apps with 'tls_passthrough' set through undecrypted, chosen by SNI")
 	flag.Parse()
+	if *legacyInterface != "" {
+		*httpListen = *legacyInterface
+	}
+	if *legacyApps != "" || *legacyManagement != "" {
+		fmt.Println("-apps and -management are deprecated and ignored, use -route to add path routes")
+	}
 
-	if enableDokkuGateway {
-		fmt.Printf("Interface:      %v\n", *if_bind)
-		fmt.Printf("Apps-Url:       %v\n", *apps_target)
-		fmt.Printf("Management-Url: %v\n", *management_target)
-
-		apps_target_url, _ := url.Parse(*apps_target)
-		management_target_url, _ := url.Parse(*management_target)
-		devices_target_url, _ := url.Parse("http://127.0.0.1:9200")
+	activated, err := systemdListeners()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	httpListeners, err := listen(*httpListen, activated)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	httpsListeners, err := listen(*httpsListen, activated)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	controlListeners, err := listen(*controlListen, activated)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	trustedProxies, err := parseTrustedProxies(*proxyProtocolFrom)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for i, listener := range httpListeners {
+		httpListeners[i] = newProxyProtoListener(listener, trustedProxies)
+	}
+	for i, listener := range httpsListeners {
+		httpsListeners[i] = newProxyProtoListener(listener, trustedProxies)
+	}
 
-		apps_proxy = proxy.New(apps_target_url)
-		management_proxy = httputil.NewSingleHostReverseProxy(management_target_url)
-		devices_proxy = httputil.NewSingleHostReverseProxy(devices_target_url)
-	} else {
-		soulNginxProxy, err = createSwitchingProxyToContainer("soul-nginx", 80)
+	gatewayConnect, err := newConnectPolicy(nil)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	gatewayConnect.idleTimeout = *connectIdleTimeout
+	gatewayStaticRoutes := &staticRoutes{fileName: *routesFile, connect: gatewayConnect}
+	for _, spec := range routeSpecs {
+		route, err := parseRouteSpec(spec)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
-
-		gatewayAppMap = &hostToProxyMap{}
-		proxyCount, err := gatewayAppMap.reload()
+		gatewayStaticRoutes.flagRoutes = append(gatewayStaticRoutes.flagRoutes, route)
+	}
+	if len(connectSpecs) == 0 {
+		connectSpecs = routeFlags{"*:22=127.0.0.1:22"}
+	}
+	for _, spec := range connectSpecs {
+		if spec == "off" {
+			continue
+		}
+		rule, err := parseConnectSpec(spec)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
+		gatewayStaticRoutes.flagConnect = append(gatewayStaticRoutes.flagConnect, rule)
+	}
 
-		fmt.Printf("%d app proxy entries loaded\n", proxyCount)
+	gatewayAccessLog, err := newAccessLog(*accessLogTarget, *accessLogFormat)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
-	proxy := createProxy()
+	soulNginxBackend, err := createSwitchingProxyToContainer(soulNginxContainer, 80)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	soulNginxProxy = &switchingHandler{handler: soulNginxBackend}
+
+	gatewayAppRegistry = newAppRegistry(skvsAppSource, dockerAppSource)
+	gatewayAppRegistry.refresh()
+	saveAppList(gatewayAppRegistry.list())
+
+	gatewayStreams := newStreamProxies(*streamIdleTimeout)
+	gatewayStreams.trustedProxies = trustedProxies
+	gatewayAppMap = &hostToProxyMap{streams: gatewayStreams}
+	prometheus.MustRegister(backendHealthCollector{gatewayAppMap})
+	if err = gatewayStaticRoutes.load(gatewayAppMap); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	proxyCount, err := gatewayAppMap.reload()
+	if _, ok := err.(reloadError); ok {
+		// the failing apps are marked unhealthy, all others are served
+		fmt.Println(err)
+	} else if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-	go func() {
-		trafficEndpoint := "0.0.0.0:80"
-		fmt.Printf("Listening at %s\n", trafficEndpoint)
-		err := http.ListenAndServe(trafficEndpoint, proxy)
-		if err != nil {
-			panic(err)
-		}
-	}()
+	fmt.Printf("%d app proxy entries loaded\n", proxyCount)
 
-	go func() {
-		controlEndpoint := "127.0.0.1:81"
-		fmt.Printf("Control endpoint listening at %s\n", controlEndpoint)
-		err := http.ListenAndServe(controlEndpoint, getControlHandler())
-		if err != nil {
-			panic(err)
+	gatewayCerts, err = newCertStore(nil)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err = gatewayCerts.reload(gatewayAppRegistry.list()); err != nil {
+		// invalid app certificates are skipped, but there has to be a box certificate
+		fmt.Println(err)
+		if _, err = gatewayCerts.getCertificate(&tls.ClientHelloInfo{}); err != nil {
+			os.Exit(1)
 		}
-	}()
+	}
 
-	go func() {
-		pemPath, keyPath, err := getSSLCert(nil)
+	go applyAppChanges(gatewayAppRegistry.subscribe())
+	go gatewayAppRegistry.watch(10*time.Second, make(chan struct{}))
+	go runDockerEventWatcher(make(chan struct{}))
+	go gatewayAppMap.watchAppExternalIPs(make(chan struct{}))
+	var gatewayACME *acmeManager
+	if *acmeDirectory != "" {
+		gatewayACME, err = newACMEManager(*acmeDirectory, *acmeEmail, *acmeCA, *acmeChallenges, gatewayCerts.client, gatewayCerts)
 		if err != nil {
-			panic(err)
+			fmt.Println(err)
+			os.Exit(1)
 		}
+		gatewayACME.appNames = gatewayAppRegistry.list
+	}
+	go gatewayCerts.watch(30*time.Second, gatewayAppRegistry.list, make(chan struct{}))
 
-		fmt.Printf("Listening (TLS)\n")
-		err = http.ListenAndServeTLS("0.0.0.0:443", pemPath, keyPath, proxy)
-		if err != nil {
-			panic(err)
+	proxy := createProxy(gatewayConnect)
+
+	servers := newServerGroup()
+	servers.serve(newServer(*httpListen, gatewayAccessLog.wrap(gatewayACME.handleHTTPChallenge(proxy))), httpListeners)
+	servers.serve(newServer(*controlListen, getControlHandler()), controlListeners)
+
+	tlsServer := newServer(*httpsListen, gatewayAccessLog.wrap(proxy))
+	tlsServer.TLSConfig = &tls.Config{GetCertificate: gatewayCerts.getCertificate}
+	if err := configureHTTP2(tlsServer, *enableHTTP2); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	gatewayACME.configureTLS(tlsServer.TLSConfig)
+	configureClientAuth(tlsServer.TLSConfig, gatewayAppMap)
+	if *enableTLSPassthrough {
+		for i, listener := range httpsListeners {
+			httpsListeners[i] = newSNIListener(listener, gatewayAppMap.passthrough, servers.conns, *streamIdleTimeout)
 		}
-	}()
+	}
+	servers.serve(tlsServer, httpsListeners)
+
+	go gatewayACME.run(time.Hour, gatewayAppMap.appHostNames, make(chan struct{}))
 
 	signal_chan := make(chan os.Signal, 10)
-	signal.Notify(signal_chan, syscall.SIGUSR1)
+	signal.Notify(signal_chan, syscall.SIGUSR1, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
 	for true {
-		<-signal_chan
-		DEBUG = !DEBUG
-		fmt.Printf("Set debug to %v.\n", DEBUG)
+		var sig os.Signal
+		select {
+		case err := <-servers.errors:
+			fmt.Println(err)
+			os.Exit(1)
+		case sig = <-signal_chan:
+		}
+
+		switch sig {
+		case syscall.SIGTERM, syscall.SIGINT:
+			fmt.Printf("Shutting down, waiting up to %s for open connections\n", *shutdownTimeout)
+			if err := servers.shutdown(*shutdownTimeout); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		case syscall.SIGUSR1:
+			DEBUG = !DEBUG
+			fmt.Printf("Set debug to %v.\n", DEBUG)
+		case syscall.SIGHUP:
+			if err := gatewayStaticRoutes.load(gatewayAppMap); err != nil {
+				fmt.Printf("Keeping previous routes, reloading failed: %s\n", err.Error())
+			}
+			if err := gatewayCerts.reload(gatewayAppRegistry.list()); err != nil {
+				fmt.Println(err)
+			}
+			if err := gatewayAccessLog.reopen(); err != nil {
+				fmt.Printf("Failed to reopen access log: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// applyAppChanges adds or removes app routes whenever apps appear or disappear.
+func applyAppChanges(events <-chan appEvent) {
+	for event := range events {
+		switch event.Type {
+		case appAdded:
+			gatewayAppMap.updateApp(event.AppName)
+		case appRemoved:
+			gatewayAppMap.removeApp(event.AppName)
+		}
 	}
 }
 
 func createReverseProxyToContainer(containerName string, port uint16) (*httputil.ReverseProxy, error) {
-	containerIP, err := getAppIP(containerName)
+	containerIPs, err := getAppIP(containerName)
 	if err != nil {
 		return nil, err
 	}
+	containerIP := containerIPs[0]
 
 	url, err := url.Parse(fmt.Sprintf("http://%s:%d/", containerIP, port))
 	if err != nil {
@@ -223,15 +330,19 @@ func createReverseProxyToContainer(containerName string, port uint16) (*httputil
 }
 
 func createSwitchingProxyToContainer(containerName string, port uint16) (http.Handler, error) {
-	containerIP, err := getAppIP(containerName)
+	containerIPs, err := getAppIP(containerName)
 	if err != nil {
 		return nil, err
 	}
+	containerIP := containerIPs[0]
 
 	url, err := url.Parse(fmt.Sprintf("http://%s:%d/", containerIP, port))
 	if err != nil {
 		return nil, err
 	}
 
-	return proxy.New(url), nil
+	p := proxy.New(url)
+	// the route label of its metrics, as in routeName
+	p.Name = containerName
+	return p, nil
 }
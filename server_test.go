@@ -1,45 +1,87 @@
 package main
 
 import (
+	"crypto/tls"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"net/http/httptest"
-	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
-
-	"github.com/experimental-platform/platform-skvs/client"
-	"github.com/experimental-platform/platform-skvs/server"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
-func TestGetSSLCert(t *testing.T) {
-	testDataPath, err := ioutil.TempDir("", "")
+// startTLSServer serves a handler like the gateway's TLS listener does.
+func startTLSServer(t *testing.T, handler http.Handler, enableHTTP2 bool) (string, func()) {
+	certPEM, keyPEM := generateCert(t, "box.local")
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
 	assert.Nil(t, err)
 
-	srv := httptest.NewServer(server.NewServerHandler(testDataPath, nil, nil))
-	c := client.NewFromURL(srv.URL)
+	server := newServer("", handler)
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	assert.Nil(t, configureHTTP2(server, enableHTTP2))
 
-	pemPath, keyPath, err := getSSLCert(c)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	assert.Nil(t, err)
-	assert.Equal(t, "/data/ssl/pem", pemPath)
-	assert.Equal(t, "/data/ssl/key", keyPath)
+	go server.ServeTLS(listener, "", "")
+	return "https://" + listener.Addr().String(), func() { server.Close() }
+}
 
-	err = c.Set("ssl/pem", "foo")
-	assert.Nil(t, err)
-	err = c.Set("ssl/key", "bar")
-	assert.Nil(t, err)
+func TestConfigureHTTP2(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	})
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
 
-	defer os.Remove("/tmp/gateway_pem")
-	defer os.Remove("/tmp/gateway_key")
-	pemPath, keyPath, err = getSSLCert(c)
-	assert.Nil(t, err)
-	assert.Equal(t, "/tmp/gateway_pem", pemPath)
-	assert.Equal(t, "/tmp/gateway_key", keyPath)
+	for enabled, proto := range map[bool]string{true: "HTTP/2.0", false: "HTTP/1.1"} {
+		url, stop := startTLSServer(t, handler, enabled)
 
-	pemData, err := ioutil.ReadFile("/tmp/gateway_pem")
+		resp, err := client.Get(url)
+		if assert.Nil(t, err) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, proto, string(body))
+		}
+		stop()
+	}
+}
+
+func TestGRPCRoute(t *testing.T) {
+	var backendProto string
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		backendProto = req.Proto
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("reply"))
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer backend.Close()
+
+	settings, err := proxyOptions{H2C: true}.build()
 	assert.Nil(t, err)
-	assert.Equal(t, "foo", string(pemData))
-	keyData, err := ioutil.ReadFile("/tmp/gateway_key")
+	route, err := newPathRoute("", "/helloworld.Greeter/", false, backend.URL, settings)
 	assert.Nil(t, err)
-	assert.Equal(t, "bar", string(keyData))
+	url, stop := startTLSServer(t, route, true)
+	defer stop()
+
+	client := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	req, _ := http.NewRequest("POST", url+"/helloworld.Greeter/SayHello", strings.NewReader("request"))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	resp, err := client.Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "reply", string(body))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "HTTP/2.0", backendProto)
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// a TLS record header and the largest record, which holds the ClientHello
+	tlsRecordSize      = 5 + 16384
+	clientHelloTimeout = 10 * time.Second
+)
+
+var errClientHelloRead = errors.New("ClientHello read")
+
+// peekServerName returns the SNI of the ClientHello at the start of a TLS
+// connection without consuming it. Clients without SNI or not talking TLS
+// get an empty name.
+func peekServerName(reader *bufio.Reader) string {
+	header, err := reader.Peek(5)
+	// 0x16 is a handshake record
+	if err != nil || header[0] != 0x16 {
+		return ""
+	}
+	record, err := reader.Peek(5 + (int(header[3])<<8 | int(header[4])))
+	if err != nil {
+		return ""
+	}
+
+	var serverName string
+	tls.Server(&helloConn{reader: bytes.NewReader(record)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	return serverName
+}
+
+// helloConn hands a peeked ClientHello to tls.Server, which can't reply.
+type helloConn struct {
+	reader io.Reader
+}
+
+func (c *helloConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c *helloConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *helloConn) Close() error                       { return nil }
+func (c *helloConn) LocalAddr() net.Addr                { return nil }
+func (c *helloConn) RemoteAddr() net.Addr               { return nil }
+func (c *helloConn) SetDeadline(t time.Time) error      { return nil }
+func (c *helloConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *helloConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// sniListener peeks at the server name of every TLS connection. Connections
+// for passthrough hosts are tunnelled to their backends undecrypted, all others
+// are returned by Accept to be terminated by the gateway.
+type sniListener struct {
+	net.Listener
+	// the target of a passthrough host, nil if it's terminated
+	passthrough func(serverName string) *passthroughTarget
+	// tunnelled connections, terminated ones are up to the server
+	conns       *connTracker
+	idleTimeout time.Duration
+
+	accepted chan net.Conn
+	// closed with err set once the listener stopped accepting
+	done chan struct{}
+	err  error
+	next uint32
+}
+
+func newSNIListener(listener net.Listener, passthrough func(string) *passthroughTarget, conns *connTracker, idleTimeout time.Duration) *sniListener {
+	l := &sniListener{
+		Listener:    listener,
+		passthrough: passthrough,
+		conns:       conns,
+		idleTimeout: idleTimeout,
+		accepted:    make(chan net.Conn),
+		done:        make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *sniListener) run() {
+	defer close(l.done)
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			return
+		}
+		go l.dispatch(conn)
+	}
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// dispatch tunnels a connection or hands it to Accept. Without SNI the
+// address the client connected to decides, like an app's external IP.
+func (l *sniListener) dispatch(conn net.Conn) {
+	reader := bufio.NewReaderSize(conn, tlsRecordSize)
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName := peekServerName(reader)
+	conn.SetReadDeadline(time.Time{})
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(conn.LocalAddr().String())
+	}
+	peeked := &bufferedConn{Conn: conn, reader: reader}
+
+	target := l.passthrough(serverName)
+	if target == nil {
+		select {
+		case l.accepted <- peeked:
+		case <-l.done:
+			conn.Close()
+		}
+		return
+	}
+
+	start := int(atomic.AddUint32(&l.next, 1))
+	forwardConn(l.conns.track(peeked), target.route, target.backends, start, target.proxyProtocol, l.idleTimeout)
+}
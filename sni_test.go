@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeekServerName(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: "gitlab.box.local"}).Handshake()
+
+	reader := bufio.NewReaderSize(server, tlsRecordSize)
+	assert.Equal(t, "gitlab.box.local", peekServerName(reader))
+	// the ClientHello is still there for whoever terminates TLS
+	header, err := reader.Peek(1)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(0x16), header[0])
+
+	reader = bufio.NewReaderSize(strings.NewReader("GET / HTTP/1.1\r\n\r\n"), tlsRecordSize)
+	assert.Equal(t, "", peekServerName(reader))
+}
+
+func TestSNIListener(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	conns := newConnTracker()
+	listener := newSNIListener(raw, func(serverName string) *passthroughTarget {
+		if serverName == "passthrough.box.local" {
+			return &passthroughTarget{route: "app:passthrough", backends: []string{backend.Listener.Addr().String()}}
+		}
+		return nil
+	}, conns, time.Minute)
+
+	certPEM, keyPEM := generateCert(t, "box.local")
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	assert.Nil(t, err)
+	server := newServer("", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("gateway"))
+	}))
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	for serverName, body := range map[string]string{
+		"passthrough.box.local": "backend",
+		"other.box.local":       "gateway",
+	} {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, ServerName: serverName},
+			DisableKeepAlives: true,
+		}}
+		resp, err := client.Get("https://" + raw.Addr().String())
+		if assert.Nil(t, err, serverName) {
+			data, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, body, string(data), serverName)
+		}
+	}
+
+	server.Close()
+	_, err = listener.Accept()
+	assert.NotNil(t, err)
+}
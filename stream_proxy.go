@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	skvs "github.com/experimental-platform/platform-skvs/client"
+)
+
+const (
+	streamDialTimeout = 10 * time.Second
+	// UDP has no end of a session, so it ends after this long without datagrams
+	udpSessionTimeout = 2 * time.Minute
+	// per listener, each session holds a socket until it times out
+	maxUDPSessions = 1024
+)
+
+// streamConfig is a port of an app forwarded as raw TCP or UDP from its external
+// IP to its containers. They are stored for an app as JSON in SKVS at
+// 'apps/<name>/streams', e.g.
+//
+//	[{"port": 22, "proxy_protocol": "v2"}, {"port": 2222, "target_port": 22}, {"port": 53, "protocol": "udp"}]
+type streamConfig struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol,omitempty"`
+	// the container port, defaults to port
+	TargetPort int `json:"target_port,omitempty"`
+	// PROXY protocol version announcing TCP clients to the containers, 'v1' or 'v2'
+	ProxyProtocol string `json:"proxy_protocol,omitempty"`
+}
+
+// streamPort is a validated streamConfig.
+type streamPort struct {
+	protocol         string
+	port, targetPort int
+	proxyProtocol    int
+}
+
+func (c streamConfig) build() (streamPort, error) {
+	port := streamPort{protocol: c.Protocol, port: c.Port, targetPort: c.TargetPort}
+	var err error
+	if port.proxyProtocol, err = parseProxyProtocol(c.ProxyProtocol); err != nil {
+		return port, err
+	}
+	if port.protocol == "" {
+		port.protocol = "tcp"
+	}
+	if port.protocol != "tcp" && port.protocol != "udp" {
+		return port, fmt.Errorf("unknown stream protocol '%s'", c.Protocol)
+	}
+	if port.protocol == "udp" && port.proxyProtocol != 0 {
+		return port, fmt.Errorf("PROXY protocol is only supported for TCP")
+	}
+	if port.targetPort == 0 {
+		port.targetPort = port.port
+	}
+	if port.port < 1 || port.port > 65535 || port.targetPort < 1 || port.targetPort > 65535 {
+		return port, fmt.Errorf("invalid stream port %d->%d", port.port, port.targetPort)
+	}
+	return port, nil
+}
+
+// getAppStreams reads the stream ports of an app from SKVS, apps without have
+// none. Failing to read them fails the app, which keeps its current listeners.
+func getAppStreams(appName string) ([]streamPort, error) {
+	data, err := skvs.Get(fmt.Sprintf("apps/%s/streams", appName))
+	if skvsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("streams of app '%s': %s", appName, err.Error())
+	}
+
+	var configs []streamConfig
+	if err = json.Unmarshal([]byte(data), &configs); err != nil {
+		return nil, fmt.Errorf("streams of app '%s': %s", appName, err.Error())
+	}
+
+	ports := make([]streamPort, 0, len(configs))
+	seen := make(map[string]bool)
+	for _, config := range configs {
+		port, err := config.build()
+		if err != nil {
+			return nil, fmt.Errorf("streams of app '%s': %s", appName, err.Error())
+		}
+		key := port.protocol + "/" + strconv.Itoa(port.port)
+		if seen[key] {
+			return nil, fmt.Errorf("streams of app '%s': duplicate port %s", appName, key)
+		}
+		seen[key] = true
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// streamProxies runs the stream listeners of all apps. A nil streamProxies
+// doesn't forward anything.
+type streamProxies struct {
+	// of TCP connections, zero means none
+	idleTimeout time.Duration
+	// sources whose PROXY protocol headers are accepted
+	trustedProxies []*net.IPNet
+
+	mutex sync.Mutex
+	apps  map[string]map[string]*streamListener
+}
+
+func newStreamProxies(idleTimeout time.Duration) *streamProxies {
+	return &streamProxies{idleTimeout: idleTimeout, apps: make(map[string]map[string]*streamListener)}
+}
+
+// update brings the listeners of an app in line with its ports at extIP.
+// Listeners which stay are kept with their connections, only their backends
+// are replaced. Without extIP all listeners of the app are closed.
+func (s *streamProxies) update(appName, extIP string, backendIPs []string, ports []streamPort) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	old := s.apps[appName]
+	current := make(map[string]*streamListener)
+	if extIP != "" {
+		for _, port := range ports {
+			addr := net.JoinHostPort(extIP, strconv.Itoa(port.port))
+			key := port.protocol + "/" + addr
+			backends := make([]string, 0, len(backendIPs))
+			for _, ip := range backendIPs {
+				backends = append(backends, net.JoinHostPort(ip, strconv.Itoa(port.targetPort)))
+			}
+
+			if listener, ok := old[key]; ok {
+				listener.setBackends(backends, port.proxyProtocol)
+				current[key] = listener
+				continue
+			}
+
+			listener, err := newStreamListener(appRouteName(appName), port.protocol, addr, backends)
+			if err != nil {
+				log.Errorf("Failed to forward %s of app '%s': %s", key, appName, err.Error())
+				continue
+			}
+			listener.proxyProtocol = port.proxyProtocol
+			if listener.tcp != nil {
+				listener.tcp = newProxyProtoListener(listener.tcp, s.trustedProxies)
+			}
+			log.Infof("Forwarding %s to app '%s'", key, appName)
+			go listener.serve(s.idleTimeout)
+			current[key] = listener
+		}
+	}
+
+	for key, listener := range old {
+		if current[key] == nil {
+			log.Infof("Stopped forwarding %s to app '%s'", key, appName)
+			listener.close()
+		}
+	}
+	if len(current) > 0 {
+		s.apps[appName] = current
+	} else {
+		delete(s.apps, appName)
+	}
+}
+
+// remove closes all listeners of an app.
+func (s *streamProxies) remove(appName string) {
+	s.update(appName, "", nil, nil)
+}
+
+// addrs returns the addresses an app is forwarded at, like 'tcp/10.0.0.5:22'.
+func (s *streamProxies) addrs(appName string) []string {
+	if s == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var addrs []string
+	for key := range s.apps[appName] {
+		addrs = append(addrs, key)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// streamListener forwards a single TCP or UDP port to the backends of an app.
+type streamListener struct {
+	route string
+	tcp   net.Listener
+	udp   net.PacketConn
+	// datagrams of new clients beyond this many sessions are dropped
+	maxSessions int
+
+	mutex         sync.RWMutex
+	backends      []string
+	proxyProtocol int
+	next          uint32
+}
+
+func newStreamListener(route, protocol, addr string, backends []string) (*streamListener, error) {
+	l := &streamListener{route: route, backends: backends, maxSessions: maxUDPSessions}
+	var err error
+	if protocol == "udp" {
+		l.udp, err = net.ListenPacket("udp", addr)
+	} else {
+		l.tcp, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *streamListener) setBackends(backends []string, proxyProtocol int) {
+	l.mutex.Lock()
+	l.backends = backends
+	l.proxyProtocol = proxyProtocol
+	l.mutex.Unlock()
+}
+
+// dial connects to the backends round robin, trying the next one if a backend fails.
+func (l *streamListener) dial(network string) (net.Conn, error) {
+	l.mutex.RLock()
+	backends := l.backends
+	l.mutex.RUnlock()
+	return dialBackends(network, backends, int(atomic.AddUint32(&l.next, 1)))
+}
+
+// forwardConn connects a client to the first backend which accepts, starting
+// with the one at start, and tunnels it there. With a proxyProtocol version
+// the client is announced to the backend by a PROXY protocol header.
+func forwardConn(client net.Conn, route string, backends []string, start, proxyProtocol int, idleTimeout time.Duration) {
+	backend, err := dialBackends("tcp", backends, start)
+	if err == nil && proxyProtocol != 0 {
+		if err = writeProxyHeader(backend, proxyProtocol, client.RemoteAddr(), client.LocalAddr()); err != nil {
+			backend.Close()
+		}
+	}
+	if err != nil {
+		log.Errorf("Forwarding %s from %s: %s", route, client.RemoteAddr().String(), err.Error())
+		client.Close()
+		return
+	}
+	recordTunnel(route, tunnel(client, backend, idleTimeout))
+}
+
+// dialBackends connects to the first backend which accepts, starting with the one at start.
+func dialBackends(network string, backends []string, start int) (net.Conn, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no backends")
+	}
+
+	var err error
+	for i := range backends {
+		var conn net.Conn
+		if conn, err = net.DialTimeout(network, backends[(start+i)%len(backends)], streamDialTimeout); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (l *streamListener) addr() net.Addr {
+	if l.udp != nil {
+		return l.udp.LocalAddr()
+	}
+	return l.tcp.Addr()
+}
+
+func (l *streamListener) close() {
+	if l.udp != nil {
+		l.udp.Close()
+	} else {
+		l.tcp.Close()
+	}
+}
+
+// serve forwards until the listener is closed. Open TCP connections outlive it.
+func (l *streamListener) serve(idleTimeout time.Duration) {
+	if l.udp != nil {
+		l.serveUDP(udpSessionTimeout)
+	} else {
+		l.serveTCP(idleTimeout)
+	}
+}
+
+func (l *streamListener) serveTCP(idleTimeout time.Duration) {
+	for {
+		conn, err := l.tcp.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return
+		}
+
+		l.mutex.RLock()
+		backends, proxyProtocol := l.backends, l.proxyProtocol
+		l.mutex.RUnlock()
+		go forwardConn(conn, l.route, backends, int(atomic.AddUint32(&l.next, 1)), proxyProtocol, idleTimeout)
+	}
+}
+
+// udpSession is the backend socket of a single client, replies are read from it.
+type udpSession struct {
+	conn     net.Conn
+	activity *tunnelActivity
+	stats    tunnelStats
+}
+
+func (l *streamListener) serveUDP(timeout time.Duration) {
+	var mutex sync.Mutex
+	sessions := make(map[string]*udpSession)
+	defer func() {
+		mutex.Lock()
+		for _, session := range sessions {
+			session.conn.Close()
+		}
+		mutex.Unlock()
+	}()
+
+	// whether the session limit has been reported
+	full := false
+	buf := make([]byte, 64*1024)
+	for {
+		n, client, err := l.udp.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return
+		}
+
+		mutex.Lock()
+		session := sessions[client.String()]
+		if session == nil && len(sessions) >= l.maxSessions {
+			mutex.Unlock()
+			// spoofed sources are cheap, so don't log every one
+			if !full {
+				log.Warningf("Forwarding %s: %d UDP sessions, dropping datagrams of new clients", l.route, l.maxSessions)
+				full = true
+			}
+			continue
+		}
+		if session == nil {
+			conn, err := l.dial("udp")
+			if err != nil {
+				mutex.Unlock()
+				log.Errorf("Forwarding %s from %s: %s", l.route, client.String(), err.Error())
+				continue
+			}
+			session = &udpSession{conn: conn, activity: &tunnelActivity{timeout: timeout}}
+			session.activity.touch()
+			sessions[client.String()] = session
+			full = false
+
+			go func(session *udpSession, client net.Addr) {
+				l.replyUDP(session, client)
+				mutex.Lock()
+				delete(sessions, client.String())
+				mutex.Unlock()
+				session.conn.Close()
+				recordTunnel(l.route, tunnelStats{
+					up:   atomic.LoadInt64(&session.stats.up),
+					down: session.stats.down,
+				})
+			}(session, client)
+		}
+		mutex.Unlock()
+
+		session.activity.touch()
+		if _, err := session.conn.Write(buf[:n]); err == nil {
+			atomic.AddInt64(&session.stats.up, int64(n))
+		}
+	}
+}
+
+// replyUDP passes the backend's replies on to the client until the session is idle.
+func (l *streamListener) replyUDP(session *udpSession, client net.Addr) {
+	buf := make([]byte, 64*1024)
+	for {
+		session.conn.SetReadDeadline(time.Now().Add(session.activity.timeout))
+		n, err := session.conn.Read(buf)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !session.activity.idle() {
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		session.activity.touch()
+		if _, err := l.udp.WriteTo(buf[:n], client); err != nil {
+			return
+		}
+		session.stats.down += int64(n)
+	}
+}
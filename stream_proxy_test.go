@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamConfig(t *testing.T) {
+	port, err := streamConfig{Port: 22}.build()
+	assert.Nil(t, err)
+	assert.Equal(t, streamPort{protocol: "tcp", port: 22, targetPort: 22}, port)
+
+	port, err = streamConfig{Port: 53, Protocol: "udp", TargetPort: 5353}.build()
+	assert.Nil(t, err)
+	assert.Equal(t, streamPort{protocol: "udp", port: 53, targetPort: 5353}, port)
+
+	for _, config := range []streamConfig{
+		{},
+		{Port: 70000},
+		{Port: 22, TargetPort: -1},
+		{Port: 22, Protocol: "sctp"},
+		{Port: 22, ProxyProtocol: "v3"},
+		{Port: 53, Protocol: "udp", ProxyProtocol: "v2"},
+	} {
+		_, err := config.build()
+		assert.NotNil(t, err, config)
+	}
+}
+
+// freePort returns a local port nothing listens at.
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestStreamProxiesTCP(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	echoPort := echo.Addr().(*net.TCPAddr).Port
+
+	streams := newStreamProxies(time.Minute)
+	port := freePort(t)
+	ports := []streamPort{{protocol: "tcp", port: port, targetPort: echoPort}}
+	streams.update("gitlab", "127.0.0.1", []string{"127.0.0.1"}, ports)
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	assert.Equal(t, []string{"tcp/" + addr}, streams.addrs("gitlab"))
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("ping\n"))
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "ping\n", line)
+
+	// unchanged ports keep their listener and connections
+	streams.update("gitlab", "127.0.0.1", []string{"127.0.0.1"}, ports)
+	conn.Write([]byte("pong\n"))
+	line, err = reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "pong\n", line)
+
+	streams.remove("gitlab")
+	assert.Empty(t, streams.addrs("gitlab"))
+	_, err = net.Dial("tcp", addr)
+	assert.NotNil(t, err)
+}
+
+// startUDPEchoServer answers every datagram with itself.
+func startUDPEchoServer(t *testing.T) net.PacketConn {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	return echo
+}
+
+func TestStreamProxiesUDP(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	listener, err := newStreamListener("app:dns", "udp", "127.0.0.1:0", []string{echo.LocalAddr().String()})
+	assert.Nil(t, err)
+	defer listener.close()
+	go listener.serveUDP(time.Second)
+
+	conn, err := net.Dial("udp", listener.addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	for _, message := range []string{"query", "another query"} {
+		conn.Write([]byte(message))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, message, string(buf[:n]))
+	}
+}
+
+func TestStreamProxiesUDPSessionLimit(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	listener, err := newStreamListener("app:dns", "udp", "127.0.0.1:0", []string{echo.LocalAddr().String()})
+	assert.Nil(t, err)
+	defer listener.close()
+	listener.maxSessions = 1
+	go listener.serveUDP(time.Second)
+
+	exchange := func(conn net.Conn) error {
+		conn.Write([]byte("query"))
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, err := conn.Read(make([]byte, 1024))
+		return err
+	}
+
+	first, err := net.Dial("udp", listener.addr().String())
+	assert.Nil(t, err)
+	defer first.Close()
+	assert.Nil(t, exchange(first))
+
+	// a second client would need another session
+	second, err := net.Dial("udp", listener.addr().String())
+	assert.Nil(t, err)
+	defer second.Close()
+	assert.NotNil(t, exchange(second))
+	assert.Nil(t, exchange(first))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/experimental-platform/platform-central-gateway/proxy"
+)
+
+// hstsConfig configures the Strict-Transport-Security header of a route.
+type hstsConfig struct {
+	// one year if empty
+	MaxAge            string `yaml:"max_age" json:"max_age,omitempty"`
+	IncludeSubdomains bool   `yaml:"include_subdomains" json:"include_subdomains,omitempty"`
+	Preload           bool   `yaml:"preload" json:"preload,omitempty"`
+}
+
+// build returns the header value.
+func (c *hstsConfig) build() (string, error) {
+	if c == nil {
+		return "", nil
+	}
+
+	maxAge, err := parseOptionalDuration("HSTS max age", c.MaxAge)
+	if err != nil {
+		return "", err
+	}
+	if maxAge == 0 {
+		maxAge = 365 * 24 * time.Hour
+	}
+
+	value := fmt.Sprintf("max-age=%d", int64(maxAge/time.Second))
+	if c.IncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if c.Preload {
+		value += "; preload"
+	}
+	return value, nil
+}
+
+// tlsPolicy makes the clients of a route use HTTPS.
+type tlsPolicy struct {
+	redirectHTTPS bool
+	// Strict-Transport-Security header, empty for none
+	hsts string
+	// only clients with a certificate signed by the box CA are served
+	clientCert bool
+}
+
+// apply redirects plain HTTP requests, checks client certificates and adds the
+// HSTS header to HTTPS responses. It returns the request to serve, nil if it was
+// answered. Requests are considered HTTPS like the proxy does for X-Forwarded-Proto,
+// ACME challenges are never redirected.
+func (p tlsPolicy) apply(w http.ResponseWriter, req *http.Request) *http.Request {
+	https := proxy.ForwardedProto(req) == "https"
+	if !https && p.redirectHTTPS && !strings.HasPrefix(req.URL.Path, acmeChallengePath) {
+		redirectHTTPS(w, req)
+		return nil
+	}
+
+	if p.clientCert {
+		// a plain HTTP request has no certificate, whatever it claims
+		if req = requireClientCert(w, req); req == nil {
+			return nil
+		}
+	}
+
+	if https && p.hsts != "" {
+		w.Header().Set("Strict-Transport-Security", p.hsts)
+	}
+	return req
+}
+
+func redirectHTTPS(w http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		// the TLS listener has the default port
+		host = h
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+	}
+
+	// browsers keep the method only on 307 and 308
+	status := http.StatusMovedPermanently
+	if req.Method != "GET" && req.Method != "HEAD" {
+		status = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), status)
+}
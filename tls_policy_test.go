@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHSTSConfig(t *testing.T) {
+	value, err := (&hstsConfig{}).build()
+	assert.Nil(t, err)
+	assert.Equal(t, "max-age=31536000", value)
+
+	value, err = (&hstsConfig{MaxAge: "1h", IncludeSubdomains: true, Preload: true}).build()
+	assert.Nil(t, err)
+	assert.Equal(t, "max-age=3600; includeSubDomains; preload", value)
+
+	var noConfig *hstsConfig
+	value, err = noConfig.build()
+	assert.Nil(t, err)
+	assert.Equal(t, "", value)
+
+	_, err = (&hstsConfig{MaxAge: "a year"}).build()
+	assert.NotNil(t, err)
+}
+
+func TestTLSPolicyRedirect(t *testing.T) {
+	policy := tlsPolicy{redirectHTTPS: true, hsts: "max-age=3600"}
+
+	for _, test := range []struct {
+		method, target, location string
+		status                   int
+	}{
+		{"GET", "http://box.local/a?b=c", "https://box.local/a?b=c", http.StatusMovedPermanently},
+		{"HEAD", "http://box.local:8080/", "https://box.local/", http.StatusMovedPermanently},
+		{"POST", "http://box.local/form", "https://box.local/form", http.StatusPermanentRedirect},
+		{"GET", "http://[::1]:80/", "https://[::1]/", http.StatusMovedPermanently},
+	} {
+		w := httptest.NewRecorder()
+		assert.Nil(t, policy.apply(w, httptest.NewRequest(test.method, test.target, nil)), test.target)
+		assert.Equal(t, test.status, w.Code, test.target)
+		assert.Equal(t, test.location, w.Header().Get("Location"), test.target)
+		assert.Equal(t, "", w.Header().Get("Strict-Transport-Security"), test.target)
+	}
+
+	// ACME challenges have to be answered on plain HTTP
+	w := httptest.NewRecorder()
+	assert.NotNil(t, policy.apply(w, httptest.NewRequest("GET", "http://box.local"+acmeChallengePath+"token", nil)))
+	assert.Equal(t, "", w.Header().Get("Location"))
+
+	// HTTPS terminated by a proxy in front of the gateway
+	req := httptest.NewRequest("GET", "http://box.local/", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w = httptest.NewRecorder()
+	assert.NotNil(t, policy.apply(w, req))
+	assert.Equal(t, "max-age=3600", w.Header().Get("Strict-Transport-Security"))
+
+	assert.NotNil(t, tlsPolicy{}.apply(httptest.NewRecorder(), httptest.NewRequest("GET", "http://box.local/", nil)))
+}
+
+func TestTLSPolicyHSTS(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://box.local/", nil)
+	req.TLS = &tls.ConnectionState{}
+
+	w := httptest.NewRecorder()
+	assert.NotNil(t, tlsPolicy{hsts: "max-age=60"}.apply(w, req))
+	assert.Equal(t, "max-age=60", w.Header().Get("Strict-Transport-Security"))
+
+	w = httptest.NewRecorder()
+	assert.NotNil(t, tlsPolicy{redirectHTTPS: true}.apply(w, req))
+	assert.Equal(t, "", w.Header().Get("Strict-Transport-Security"))
+
+	// plain HTTP responses must not carry the header
+	w = httptest.NewRecorder()
+	assert.NotNil(t, tlsPolicy{hsts: "max-age=60"}.apply(w, httptest.NewRequest("GET", "http://box.local/", nil)))
+	assert.Equal(t, "", w.Header().Get("Strict-Transport-Security"))
+}
+
+func TestPathRouteTLSPolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Header.Get("X-Forwarded-Proto")))
+	}))
+	defer backend.Close()
+
+	settings, err := proxyOptions{RedirectHTTPS: true, HSTS: &hstsConfig{MaxAge: "1h"}}.build()
+	assert.Nil(t, err)
+	route, err := newPathRoute("", "/", false, backend.URL, settings)
+	assert.Nil(t, err)
+
+	w := httptest.NewRecorder()
+	route.ServeHTTP(w, httptest.NewRequest("GET", "http://box.local/x", nil))
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "https://box.local/x", w.Header().Get("Location"))
+
+	req := httptest.NewRequest("GET", "https://box.local/x", nil)
+	req.TLS = &tls.ConnectionState{}
+	w = httptest.NewRecorder()
+	route.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https", w.Body.String())
+	assert.Equal(t, "max-age=3600", w.Header().Get("Strict-Transport-Security"))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelStats counts the bytes a tunnel copied.
+type tunnelStats struct {
+	// from the client to the service
+	up int64
+	// from the service to the client
+	down int64
+}
+
+// tunnel copies data between a client and a service until both directions are
+// done. The end of one direction is passed on as half-close, so protocols relying
+// on it keep working. The tunnel is torn down after idleTimeout without data in
+// either direction, zero means never. Both connections are closed on return.
+func tunnel(client, service net.Conn, idleTimeout time.Duration) tunnelStats {
+	defer client.Close()
+	defer service.Close()
+
+	activity := &tunnelActivity{timeout: idleTimeout}
+	activity.touch()
+
+	var stats tunnelStats
+	done := make(chan error, 2)
+	go func() {
+		var err error
+		stats.up, err = activity.copy(service, client)
+		done <- err
+	}()
+	go func() {
+		var err error
+		stats.down, err = activity.copy(client, service)
+		done <- err
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			// unblocks the other direction
+			client.Close()
+			service.Close()
+		}
+	}
+	return stats
+}
+
+// tunnelActivity tracks when a tunnel last copied data.
+type tunnelActivity struct {
+	timeout time.Duration
+	last    int64
+}
+
+func (a *tunnelActivity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+func (a *tunnelActivity) idle() bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last))) >= a.timeout
+}
+
+// copy copies from src to dst until src ends, which is passed on by closing dst
+// for writing. Read timeouts are only fatal once the whole tunnel is idle.
+func (a *tunnelActivity) copy(dst, src net.Conn) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		if a.timeout > 0 {
+			src.SetReadDeadline(time.Now().Add(a.timeout))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			a.touch()
+			if a.timeout > 0 {
+				dst.SetWriteDeadline(time.Now().Add(a.timeout))
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+
+		if err == io.EOF {
+			return written, closeWrite(dst)
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !a.idle() {
+			continue
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+type halfCloser interface {
+	CloseWrite() error
+}
+
+var errNoHalfClose = errors.New("connection can't be half-closed")
+
+// closeWrite half-closes a connection, connections which can't are closed completely.
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(halfCloser); ok {
+		if err := c.CloseWrite(); err != errNoHalfClose {
+			return err
+		}
+	}
+	return conn.Close()
+}
+
+// closeWrapped passes CloseWrite on to the connection wrapped by a net.Conn.
+func closeWrapped(conn net.Conn) error {
+	if c, ok := conn.(halfCloser); ok {
+		return c.CloseWrite()
+	}
+	return errNoHalfClose
+}
+
+// bufferedConn is a hijacked connection whose reader may already hold data of the client.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrapped(c.Conn)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnelPipe(t *testing.T) {
+	client, clientEnd := net.Pipe()
+	service, serviceEnd := net.Pipe()
+	result := make(chan tunnelStats)
+	go func() { result <- tunnel(clientEnd, serviceEnd, 0) }()
+
+	go client.Write([]byte("request"))
+	buf := make([]byte, 7)
+	_, err := service.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "request", string(buf))
+
+	go service.Write([]byte("reply"))
+	buf = make([]byte, 5)
+	_, err = client.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "reply", string(buf))
+
+	// pipes can't be half-closed, the end of the client ends the tunnel
+	client.Close()
+	_, err = ioutil.ReadAll(service)
+	assert.Nil(t, err)
+	service.Close()
+
+	select {
+	case stats := <-result:
+		assert.Equal(t, tunnelStats{up: 7, down: 5}, stats)
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel didn't end")
+	}
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	client, clientEnd := net.Pipe()
+	service, serviceEnd := net.Pipe()
+	defer client.Close()
+	defer service.Close()
+	result := make(chan tunnelStats)
+	go func() { result <- tunnel(clientEnd, serviceEnd, 100*time.Millisecond) }()
+
+	// activity in one direction keeps the other one open
+	for i := 0; i < 3; i++ {
+		time.Sleep(60 * time.Millisecond)
+		go client.Write([]byte("x"))
+		_, err := service.Read(make([]byte, 1))
+		assert.Nil(t, err)
+	}
+
+	select {
+	case stats := <-result:
+		assert.Equal(t, tunnelStats{up: 3}, stats)
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle tunnel wasn't closed")
+	}
+	_, err := client.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	result := make(chan tunnelStats)
+	go func() {
+		conn, err := listener.Accept()
+		if !assert.Nil(t, err) {
+			return
+		}
+		service, err := net.Dial("tcp", echo.Addr().String())
+		if !assert.Nil(t, err) {
+			conn.Close()
+			return
+		}
+		// wrapped like hijacked connections are
+		tracked := &trackedConn{Conn: conn, tracker: newConnTracker()}
+		client := &bufferedConn{Conn: tracked, reader: bufio.NewReader(tracked)}
+		result <- tunnel(client, service, time.Minute)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	assert.Nil(t, err)
+	// the reply still arrives after the client is done sending
+	assert.Nil(t, conn.(*net.TCPConn).CloseWrite())
+
+	reply, err := ioutil.ReadAll(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(reply))
+
+	select {
+	case stats := <-result:
+		assert.Equal(t, tunnelStats{up: 4, down: 4}, stats)
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel didn't end")
+	}
+}
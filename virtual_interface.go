@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	skvs "github.com/experimental-platform/platform-skvs/client"
@@ -42,6 +43,15 @@ func appIfName(appName string) string {
 	return fmt.Sprintf("app_%s0", appName)
 }
 
+// appNameFromIfName is the inverse of appIfName.
+func appNameFromIfName(ifName string) (string, bool) {
+	if !strings.HasPrefix(ifName, "app_") || !strings.HasSuffix(ifName, "0") || len(ifName) <= len("app_0") {
+		return "", false
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(ifName, "app_"), "0"), true
+}
+
 func createAppInterface(appName string) error {
 	ifName := appIfName(appName)
 	_, err := net.InterfaceByName(ifName)